@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	CommonAccessLogFormat   = "common"
+	CombinedAccessLogFormat = "combined"
+	JSONAccessLogFormat     = "json"
+
+	StderrAccessLog = "-"
+
+	ForwardedAction = "forwarded"
+	QueuedAction    = "queued"
+	RejectedAction  = "rejected"
+	ReplayedAction  = "replayed"
+
+	accessLogTimeFormat   = "02/Jan/2006:15:04:05 -0700"
+	accessLogBackupFormat = "20060102T150405.000"
+)
+
+type AccessLogConfig struct {
+	Path       string        `long:"path" description:"path to access log file or '-' for stderr (access log is disabled by default)"`
+	Format     string        `long:"format" default:"combined" choice:"common" choice:"combined" choice:"json" description:"format of access log"`
+	MaxSize    int64         `long:"max-size" default:"0" description:"rotate access log when its size exceeds this number of bytes (0 - no rotation by size)"`
+	MaxAge     time.Duration `long:"max-age" default:"0s" description:"rotate access log after this period (0 - no rotation by time)"`
+	MaxBackups int           `long:"max-backups" default:"0" description:"maximum number of rotated access logs to keep (0 - keep all)"`
+}
+
+// AccessLogEntry describes what leska did with request. Live requests are
+// forwarded, queued (failed and stored to repeate) or rejected, repeated requests
+// are replayed.
+type AccessLogEntry struct {
+	Time           time.Time `json:"time"`
+	Client         string    `json:"client"`
+	Method         string    `json:"method"`
+	URL            string    `json:"url"`
+	Proto          string    `json:"proto"`
+	Referer        string    `json:"referer,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Upstream       string    `json:"upstream,omitempty"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	Status         int       `json:"status,omitempty"` // status returned to client
+	Latency        float64   `json:"latency_ms"`
+	Action         string    `json:"action"`
+}
+
+func NewAccessLogEntry(request *http.Request, start time.Time, requestLog *RequestLog,
+	action string, status int) *AccessLogEntry {
+
+	client := request.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	return &AccessLogEntry{
+		Time:           start,
+		Client:         client,
+		Method:         request.Method,
+		URL:            request.RequestURI,
+		Proto:          request.Proto,
+		Referer:        request.Referer(),
+		UserAgent:      request.UserAgent(),
+		RequestID:      requestLog.RequestID,
+		Upstream:       requestLog.Upstream,
+		UpstreamStatus: requestLog.Status,
+		Status:         status,
+		Latency:        time.Since(start).Seconds() * 1000,
+		Action:         action,
+	}
+}
+
+// AccessLog writes entries in common or combined log format (with leska-specific
+// fields at the end of line) or as JSON objects. Nil access log is disabled.
+type AccessLog struct {
+	logger *logging.Logger
+	format string
+	mutex  sync.Mutex
+	writer io.WriteCloser
+}
+
+// NewAccessLog creates access log, it returns nil if access log is disabled.
+func NewAccessLog(logger *logging.Logger, config AccessLogConfig) (*AccessLog, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+	accessLog := &AccessLog{logger: logger, format: config.Format}
+	if config.Path == StderrAccessLog {
+		accessLog.writer = nopWriteCloser{os.Stderr}
+		return accessLog, nil
+	}
+	writer, err := openRotatingFile(logger, config)
+	if err != nil {
+		return nil, err
+	}
+	accessLog.writer = writer
+	return accessLog, nil
+}
+
+func (l *AccessLog) Close() {
+	if l != nil {
+		l.writer.Close()
+	}
+}
+
+func (l *AccessLog) Log(entry *AccessLogEntry) {
+	if l == nil {
+		return
+	}
+	line, err := l.formatEntry(entry)
+	if err != nil {
+		l.logger.Errorf("cannot format access log entry: %v", err)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.writer.Write(line); err != nil {
+		l.logger.Errorf("cannot write access log: %v", err)
+	}
+}
+
+func (l *AccessLog) formatEntry(entry *AccessLogEntry) ([]byte, error) {
+	if l.format == JSONAccessLogFormat {
+		line, err := json.Marshal(entry)
+		return append(line, '\n'), err
+	}
+
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %s -", orDash(entry.Client),
+		entry.Time.Format(accessLogTimeFormat), entry.Method, entry.URL, entry.Proto,
+		statusOrDash(entry.Status))
+	if l.format == CombinedAccessLogFormat {
+		line += fmt.Sprintf(" %q %q", orDash(entry.Referer), orDash(entry.UserAgent))
+	}
+	line += fmt.Sprintf(" %s %s %s %.3f %s\n", orDash(entry.RequestID), orDash(entry.Upstream),
+		statusOrDash(entry.UpstreamStatus), entry.Latency, entry.Action)
+	return []byte(line), nil
+}
+
+// File which is rotated by size or time. Rotated file is renamed by adding of
+// rotation time to its name. Entries are written to current file if rotation
+// fails, next rotation is tried after the same size or period.
+type rotatingFile struct {
+	logger *logging.Logger
+	config AccessLogConfig
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(logger *logging.Logger, config AccessLogConfig) (*rotatingFile, error) {
+	file := &rotatingFile{logger: logger, config: config}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	if f.needRotate(len(data)) {
+		if err := f.rotate(); err != nil {
+			f.logger.Errorf("cannot rotate access log: %v", err)
+			f.size, f.opened = 0, time.Now()
+		}
+	}
+	written, err := f.file.Write(data)
+	f.size += int64(written)
+	return written, err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *rotatingFile) open() error {
+	file, size, err := openAccessLogFile(f.config.Path)
+	if err != nil {
+		return err
+	}
+	f.file, f.size, f.opened = file, size, time.Now()
+	return nil
+}
+
+func (f *rotatingFile) needRotate(size int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.config.MaxSize > 0 && f.size+int64(size) > f.config.MaxSize {
+		return true
+	}
+	return f.config.MaxAge > 0 && time.Since(f.opened) > f.config.MaxAge
+}
+
+// rotate renames current file and opens new one, current file is closed only
+// after that, so it is kept if file cannot be rotated.
+func (f *rotatingFile) rotate() error {
+	backupPath := f.config.Path + "." + time.Now().Format(accessLogBackupFormat)
+	if err := os.Rename(f.config.Path, backupPath); err != nil {
+		return errors.Wrapf(err, "cannot rotate access log '%s'", f.config.Path)
+	}
+	file, size, err := openAccessLogFile(f.config.Path)
+	if err != nil {
+		// Current file is returned back, so it is written under its own name.
+		if renameErr := os.Rename(backupPath, f.config.Path); renameErr != nil {
+			f.logger.Errorf("cannot restore access log '%s': %v", f.config.Path, renameErr)
+		}
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		f.logger.Errorf("cannot close rotated access log '%s': %v", backupPath, err)
+	}
+	f.file, f.size, f.opened = file, size, time.Now()
+	if err := f.removeBackups(); err != nil {
+		f.logger.Errorf("cannot remove old access logs: %v", err)
+	}
+	return nil
+}
+
+func (f *rotatingFile) removeBackups() error {
+	if f.config.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.config.Path + ".*")
+	if err != nil {
+		return errors.Wrapf(err, "cannot list rotated access logs '%s'", f.config.Path)
+	}
+	// Names of backups contain rotation time, so they are sorted from oldest to newest.
+	sort.Strings(backups)
+	for len(backups) > f.config.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return errors.Wrapf(err, "cannot remove rotated access log '%s'", backups[0])
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (w nopWriteCloser) Close() error {
+	return nil
+}
+
+// Helpers
+func openAccessLogFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "cannot open access log '%s'", path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, errors.Wrapf(err, "cannot get size of access log '%s'", path)
+	}
+	return file, info.Size(), nil
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func statusOrDash(status int) string {
+	if status == 0 {
+		return "-"
+	}
+	return fmt.Sprint(status)
+}
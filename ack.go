@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	AcceptedAckMode = "accepted"
+	JSONAckMode     = "json"
+	UpstreamAckMode = "upstream"
+	CustomAckMode   = "custom"
+	HoldAckMode     = "hold"
+
+	modeParameter         = "mode"
+	statusParameter       = "status"
+	headerParameter       = "header"
+	bodyParameter         = "body"
+	holdTimeoutParameter  = "hold-timeout"
+	holdIntervalParameter = "hold-interval"
+)
+
+type AckConfig struct {
+	Mode         string        `long:"mode" default:"accepted" choice:"accepted" choice:"json" choice:"upstream" choice:"custom" choice:"hold" description:"acknowledgement of queued request: 'accepted' (202 with status text), 'json' (202 with JSON body), 'upstream' (upstream error), 'custom' (status, headers and body template), 'hold' (202 if fast retries fail)"`
+	Status       int           `long:"status" default:"202" description:"status of custom acknowledgement"`
+	Headers      []string      `long:"header" description:"header of custom acknowledgement ('<name>: <value>')"`
+	Body         string        `long:"body" description:"template of body of custom acknowledgement (fields: .RequestID, .TrackingID, .Location, .UpstreamStatus)"`
+	HoldTimeout  time.Duration `long:"hold-timeout" default:"5s" description:"maximum time to retry request in hold mode before it is acknowledged"`
+	HoldInterval time.Duration `long:"hold-interval" default:"500ms" description:"delay between retries in hold mode"`
+	Routes       []string      `long:"route" description:"acknowledgement of requests which path matches glob pattern, settings are set by query parameters: mode, status, header, body, hold-timeout, hold-interval (e.g. '/orders/*?mode=hold&hold-timeout=3s')"`
+}
+
+// AckData is data of acknowledgement of queued request, it is returned in JSON
+// mode and is available in body template of custom mode.
+type AckData struct {
+	RequestID      string `json:"request_id"`
+	TrackingID     string `json:"tracking_id,omitempty"`
+	Location       string `json:"location,omitempty"`
+	UpstreamStatus int    `json:"upstream_status"`
+}
+
+// Acknowledgement describes response to client if request is queued.
+type Acknowledgement struct {
+	Mode         string
+	Status       int
+	Header       http.Header
+	Body         *template.Template
+	HoldTimeout  time.Duration
+	HoldInterval time.Duration
+}
+
+type ackRoute struct {
+	pattern string
+	ack     *Acknowledgement
+}
+
+// Acknowledger chooses acknowledgement of queued request by its path. The first
+// matched route is used, default acknowledgement is used if there is no one.
+type Acknowledger struct {
+	routes     []ackRoute
+	defaultAck *Acknowledgement
+}
+
+func NewAcknowledger(config AckConfig) (*Acknowledger, error) {
+	defaultQuery := url.Values{
+		modeParameter:         []string{config.Mode},
+		statusParameter:       []string{strconv.Itoa(config.Status)},
+		headerParameter:       config.Headers,
+		bodyParameter:         []string{config.Body},
+		holdTimeoutParameter:  []string{config.HoldTimeout.String()},
+		holdIntervalParameter: []string{config.HoldInterval.String()},
+	}
+	defaultAck, err := parseAcknowledgement(defaultQuery, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "incorrect default acknowledgement")
+	}
+
+	acknowledger := &Acknowledger{defaultAck: defaultAck}
+	for _, route := range config.Routes {
+		// Settings follow the first '?', so it cannot be used as wildcard of pattern.
+		pattern, rawQuery := route, ""
+		if position := strings.Index(route, "?"); position >= 0 {
+			pattern, rawQuery = route[:position], route[position+1:]
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "incorrect pattern of route '%s'", route)
+		}
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse settings of route '%s'", route)
+		}
+		ack, err := parseAcknowledgement(query, defaultAck)
+		if err != nil {
+			return nil, errors.Wrapf(err, "incorrect acknowledgement of route '%s'", route)
+		}
+		acknowledger.routes = append(acknowledger.routes, ackRoute{pattern: pattern, ack: ack})
+	}
+	return acknowledger, nil
+}
+
+// Select returns acknowledgement of request.
+func (a *Acknowledger) Select(request *http.Request) *Acknowledgement {
+	for _, route := range a.routes {
+		if matched, _ := path.Match(route.pattern, request.URL.Path); matched {
+			return route.ack
+		}
+	}
+	return a.defaultAck
+}
+
+// Write writes acknowledgement of queued request and returns its status.
+// Upstream response is written in upstream mode. Request which is queued
+// without forwarding has no upstream response (it is nil), so it gets accepted
+// acknowledgement in upstream mode.
+func (a *Acknowledgement) Write(inResponse http.ResponseWriter, response *Response,
+	data *AckData) (int, error) {
+
+	mode := a.Mode
+	if mode == UpstreamAckMode && response == nil {
+		mode = AcceptedAckMode
+	}
+	switch mode {
+	case UpstreamAckMode:
+		// Request id is already set, it must not be duplicated if upstream returns it.
+		response.Header().Del(RequestIDHeader)
+		return response.code, response.Copy(inResponse)
+	case JSONAckMode:
+		body, err := json.Marshal(data)
+		if err != nil {
+			return 0, errors.Wrap(err, "cannot encode acknowledgement")
+		}
+		setLocation(inResponse, data)
+		inResponse.Header().Set("Content-Type", "application/json")
+		inResponse.WriteHeader(http.StatusAccepted)
+		inResponse.Write(body)
+		return http.StatusAccepted, nil
+	case CustomAckMode:
+		body := &bytes.Buffer{}
+		if a.Body != nil {
+			if err := a.Body.Execute(body, data); err != nil {
+				return 0, errors.Wrap(err, "cannot execute template of acknowledgement")
+			}
+		}
+		setLocation(inResponse, data)
+		utils.CopyHeaders(inResponse.Header(), a.Header)
+		inResponse.WriteHeader(a.Status)
+		inResponse.Write(body.Bytes())
+		return a.Status, nil
+	default:
+		setLocation(inResponse, data)
+		inResponse.WriteHeader(http.StatusAccepted)
+		inResponse.Write([]byte(http.StatusText(http.StatusAccepted)))
+		return http.StatusAccepted, nil
+	}
+}
+
+// Helpers
+// parseAcknowledgement parses settings of acknowledgement, unset settings are
+// taken from defaults.
+func parseAcknowledgement(query url.Values, defaults *Acknowledgement) (*Acknowledgement, error) {
+	ack := &Acknowledgement{Header: make(http.Header)}
+	if defaults != nil {
+		*ack = *defaults
+	}
+
+	var err error
+	if mode := query.Get(modeParameter); mode != "" {
+		switch mode {
+		case AcceptedAckMode, JSONAckMode, UpstreamAckMode, CustomAckMode, HoldAckMode:
+			ack.Mode = mode
+		default:
+			return nil, errors.Errorf("unknown acknowledgement mode '%s'", mode)
+		}
+	}
+	if status := query.Get(statusParameter); status != "" {
+		if ack.Status, err = strconv.Atoi(status); err != nil || ack.Status < 100 || 599 < ack.Status {
+			return nil, errors.Errorf("incorrect status of acknowledgement '%s'", status)
+		}
+	}
+	if headers, exist := query[headerParameter]; exist {
+		ack.Header = make(http.Header)
+		for _, header := range headers {
+			parts := strings.SplitN(header, ":", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return nil, errors.Errorf("incorrect header of acknowledgement '%s'", header)
+			}
+			ack.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	if body := query.Get(bodyParameter); body != "" {
+		if ack.Body, err = template.New("ack").Parse(body); err != nil {
+			return nil, errors.Wrap(err, "cannot parse template of acknowledgement")
+		}
+	}
+	if timeout := query.Get(holdTimeoutParameter); timeout != "" {
+		if ack.HoldTimeout, err = time.ParseDuration(timeout); err != nil {
+			return nil, errors.Wrapf(err, "incorrect hold timeout '%s'", timeout)
+		}
+	}
+	if interval := query.Get(holdIntervalParameter); interval != "" {
+		if ack.HoldInterval, err = time.ParseDuration(interval); err != nil || ack.HoldInterval <= 0 {
+			return nil, errors.Errorf("incorrect hold interval '%s'", interval)
+		}
+	}
+	return ack, nil
+}
+
+func setLocation(inResponse http.ResponseWriter, data *AckData) {
+	if data.TrackingID != "" {
+		inResponse.Header().Set(TrackingIDHeader, data.TrackingID)
+		inResponse.Header().Set("Location", data.Location)
+	}
+}
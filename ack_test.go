@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for acknowledgement tests.
+func createTestAcknowledger(t *testing.T, routes ...string) *Acknowledger {
+	acknowledger, err := NewAcknowledger(AckConfig{
+		Mode:         AcceptedAckMode,
+		Status:       http.StatusAccepted,
+		HoldTimeout:  5 * time.Second,
+		HoldInterval: 500 * time.Millisecond,
+		Routes:       routes,
+	})
+	require.NoError(t, err, "cannot create acknowledger")
+	return acknowledger
+}
+
+func selectTestAck(acknowledger *Acknowledger, path string) *Acknowledgement {
+	return acknowledger.Select(httptest.NewRequest(http.MethodPost, path, nil))
+}
+
+func createTestUpstreamResponse(t *testing.T, status int, body string) *Response {
+	response, err := NewResponse()
+	require.NoError(t, err, "cannot create response")
+	response.Header().Set("X-Upstream", "test")
+	response.Header().Set(RequestIDHeader, "upstream-id")
+	response.WriteHeader(status)
+	_, err = response.Write([]byte(body))
+	require.NoError(t, err, "cannot write response body")
+	return response
+}
+
+// Acknowledgement tests.
+func TestAcknowledgerRoutes(t *testing.T) {
+	acknowledger := createTestAcknowledger(t,
+		"/orders/*?mode=hold&hold-timeout=3s",
+		"/orders/*?mode=json",
+		"/users/*?mode=custom&status=200&header=X-First:%201&header=X-Second:2&body={{.RequestID}}")
+
+	ack := selectTestAck(acknowledger, "/orders/1")
+	require.Equal(t, HoldAckMode, ack.Mode, "the first matched route must be used")
+	require.Equal(t, 3*time.Second, ack.HoldTimeout, "incorrect hold timeout of route")
+	require.Equal(t, 500*time.Millisecond, ack.HoldInterval, "unset setting must be taken from defaults")
+
+	ack = selectTestAck(acknowledger, "/users/1")
+	require.Equal(t, CustomAckMode, ack.Mode, "incorrect mode of route")
+	require.Equal(t, http.StatusOK, ack.Status, "incorrect status of route")
+	require.Equal(t, "1", ack.Header.Get("X-First"), "incorrect header of route")
+	require.Equal(t, "2", ack.Header.Get("X-Second"), "incorrect header of route")
+	require.NotNil(t, ack.Body, "body template of route must be parsed")
+
+	ack = selectTestAck(acknowledger, "/other")
+	require.Equal(t, AcceptedAckMode, ack.Mode, "default acknowledgement must be used")
+	require.Equal(t, http.StatusAccepted, ack.Status, "incorrect default status")
+
+	for _, route := range []string{"[?mode=json", "/orders?mode=unknown", "/orders?status=99",
+		"/orders?status=ok", "/orders?header=X-Header", "/orders?header=:value", "/orders?body={{.Unclosed",
+		"/orders?hold-timeout=soon", "/orders?hold-interval=0s"} {
+
+		_, err := NewAcknowledger(AckConfig{Mode: AcceptedAckMode, Status: http.StatusAccepted,
+			HoldInterval: time.Second, Routes: []string{route}})
+		require.Error(t, err, "incorrect route '%s' must not be parsed", route)
+	}
+	_, err := NewAcknowledger(AckConfig{Mode: AcceptedAckMode, Status: http.StatusAccepted})
+	require.Error(t, err, "default hold interval must be positive")
+}
+
+func TestAcknowledgementWrite(t *testing.T) {
+	data := &AckData{RequestID: "request", TrackingID: "tracking", Location: "/status/tracking",
+		UpstreamStatus: http.StatusServiceUnavailable}
+
+	// Accepted mode.
+	recorder := httptest.NewRecorder()
+	status, err := (&Acknowledgement{Mode: AcceptedAckMode}).Write(recorder, nil, data)
+	require.NoError(t, err, "cannot write acknowledgement")
+	require.Equal(t, http.StatusAccepted, status, "incorrect returned status")
+	require.Equal(t, http.StatusAccepted, recorder.Code, "incorrect status of acknowledgement")
+	require.Equal(t, http.StatusText(http.StatusAccepted), recorder.Body.String(), "incorrect body")
+	require.Equal(t, "tracking", recorder.Header().Get(TrackingIDHeader), "tracking id must be set")
+	require.Equal(t, "/status/tracking", recorder.Header().Get("Location"), "location must be set")
+
+	// JSON mode.
+	recorder = httptest.NewRecorder()
+	status, err = (&Acknowledgement{Mode: JSONAckMode}).Write(recorder, nil, data)
+	require.NoError(t, err, "cannot write acknowledgement")
+	require.Equal(t, http.StatusAccepted, status, "incorrect returned status")
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"), "incorrect content type")
+	written := &AckData{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), written), "cannot decode acknowledgement")
+	require.Equal(t, data, written, "incorrect body of acknowledgement")
+
+	// Custom mode.
+	acknowledger := createTestAcknowledger(t,
+		"/*?mode=custom&status=200&header=X-Custom:value&body={{.RequestID}}:{{.UpstreamStatus}}")
+	recorder = httptest.NewRecorder()
+	status, err = selectTestAck(acknowledger, "/orders").Write(recorder, nil, data)
+	require.NoError(t, err, "cannot write acknowledgement")
+	require.Equal(t, http.StatusOK, status, "incorrect returned status")
+	require.Equal(t, http.StatusOK, recorder.Code, "incorrect status of acknowledgement")
+	require.Equal(t, "value", recorder.Header().Get("X-Custom"), "incorrect header of acknowledgement")
+	require.Equal(t, "request:503", recorder.Body.String(), "incorrect body of acknowledgement")
+	require.Equal(t, "tracking", recorder.Header().Get(TrackingIDHeader), "tracking id must be set")
+
+	// Upstream mode.
+	response := createTestUpstreamResponse(t, http.StatusServiceUnavailable, "unavailable")
+	defer response.Close()
+	recorder = httptest.NewRecorder()
+	status, err = (&Acknowledgement{Mode: UpstreamAckMode}).Write(recorder, response, data)
+	require.NoError(t, err, "cannot write acknowledgement")
+	require.Equal(t, http.StatusServiceUnavailable, status, "incorrect returned status")
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code, "upstream status must be returned")
+	require.Equal(t, "unavailable", recorder.Body.String(), "upstream body must be returned")
+	require.Equal(t, "test", recorder.Header().Get("X-Upstream"), "upstream header must be returned")
+	require.Empty(t, recorder.Header().Get(RequestIDHeader), "request id of upstream must be removed")
+
+	// Request which is queued without forwarding has no upstream response.
+	recorder = httptest.NewRecorder()
+	status, err = (&Acknowledgement{Mode: UpstreamAckMode}).Write(recorder, nil, data)
+	require.NoError(t, err, "cannot write acknowledgement")
+	require.Equal(t, http.StatusAccepted, status, "request without response must be accepted")
+}
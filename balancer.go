@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	RoundRobinStrategy = "roundrobin"
+	LeastConnStrategy  = "leastconn"
+	HashStrategy       = "hash"
+
+	weightParameter        = "weight"
+	balancerParameter      = "balancer"
+	hashKeyParameter       = "hash-key"
+	tlsCAParameter         = "tls-ca"
+	tlsCertParameter       = "tls-cert"
+	tlsKeyParameter        = "tls-key"
+	tlsServerNameParameter = "tls-server-name"
+
+	defaultWeight = 1
+	hashReplicas  = 100
+)
+
+type Upstream struct {
+	URL    *url.URL
+	Weight int
+	TLS    *tls.Config
+}
+
+// ParseUpstream parses upstream address. Settings of upstream are set by query
+// parameters, these parameters are removed from the resulting URL:
+//
+//	weight          - weight of upstream (e.g. http://host:8080?weight=3);
+//	tls-ca          - path to CA bundle to verify upstream certificate;
+//	tls-cert        - path to client certificate;
+//	tls-key         - path to key of client certificate;
+//	tls-server-name - server name used for SNI and certificate verification.
+func ParseUpstream(upstream string) (*Upstream, error) {
+	upstreamUrl, err := url.Parse(upstream)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse upstream address '%s'", upstream)
+	}
+
+	query := upstreamUrl.Query()
+	weight := defaultWeight
+	if value := popParameter(query, weightParameter); value != "" {
+		if weight, err = strconv.Atoi(value); err != nil || weight <= 0 {
+			return nil, errors.Errorf("incorrect weight of upstream '%s'", upstream)
+		}
+	}
+	tlsSettings := UpstreamTLSConfig{
+		CA:         popParameter(query, tlsCAParameter),
+		Cert:       popParameter(query, tlsCertParameter),
+		Key:        popParameter(query, tlsKeyParameter),
+		ServerName: popParameter(query, tlsServerNameParameter),
+	}
+	upstreamUrl.RawQuery = query.Encode()
+
+	result := &Upstream{URL: upstreamUrl, Weight: weight}
+	if !tlsSettings.IsEmpty() {
+		if result.TLS, err = CreateClientTLSConfig(tlsSettings); err != nil {
+			return nil, errors.Wrapf(err, "cannot create TLS config of upstream '%s'", upstream)
+		}
+	}
+	return result, nil
+}
+
+func ParseUpstreams(upstreams []string) ([]*Upstream, error) {
+	result := make([]*Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		parsedUpstream, err := ParseUpstream(upstream)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, parsedUpstream)
+	}
+	return result, nil
+}
+
+func CreateBalancer(next http.Handler, strategy string, hashKey string,
+	upstreams []*Upstream) (http.Handler, error) {
+
+	switch strategy {
+	case RoundRobinStrategy:
+		return NewRoundRobinBalancer(next, upstreams)
+	case LeastConnStrategy:
+		return NewLeastConnBalancer(next, upstreams), nil
+	case HashStrategy:
+		keyFunc, err := ParseHashKey(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return NewHashBalancer(next, keyFunc, upstreams), nil
+	}
+	return nil, errors.Errorf("unknown balancing strategy '%s'", strategy)
+}
+
+// RoutedBalancer chooses balancer of request by its path. The first matched
+// route is used, default balancer is used if there is no one.
+type RoutedBalancer struct {
+	routes         []balancerRoute
+	defaultHandler http.Handler
+}
+
+type balancerRoute struct {
+	pattern string
+	handler http.Handler
+}
+
+// CreateRoutedBalancer creates default balancer and balancers of routes. Route
+// is glob pattern of path with settings which are set by query parameters:
+// balancer and hash-key (e.g. '/users/*?balancer=hash&hash-key=header:X-User').
+// Unset settings are taken from defaults.
+func CreateRoutedBalancer(next http.Handler, strategy string, hashKey string, routes []string,
+	upstreams []*Upstream) (http.Handler, error) {
+
+	defaultHandler, err := CreateBalancer(next, strategy, hashKey, upstreams)
+	if err != nil || len(routes) == 0 {
+		return defaultHandler, err
+	}
+	balancer := &RoutedBalancer{defaultHandler: defaultHandler}
+	for _, route := range routes {
+		// Settings follow the first '?', so it cannot be used as wildcard of pattern.
+		pattern, rawQuery := route, ""
+		if position := strings.Index(route, "?"); position >= 0 {
+			pattern, rawQuery = route[:position], route[position+1:]
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "incorrect pattern of balancer route '%s'", route)
+		}
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse settings of balancer route '%s'", route)
+		}
+		routeStrategy, routeHashKey := strategy, hashKey
+		if value := popParameter(query, balancerParameter); value != "" {
+			routeStrategy = value
+		}
+		if value := popParameter(query, hashKeyParameter); value != "" {
+			routeHashKey = value
+		}
+		for name := range query {
+			return nil, errors.Errorf("unknown setting '%s' of balancer route '%s'", name, route)
+		}
+		handler, err := CreateBalancer(next, routeStrategy, routeHashKey, upstreams)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create balancer of route '%s'", route)
+		}
+		balancer.routes = append(balancer.routes, balancerRoute{pattern: pattern, handler: handler})
+	}
+	return balancer, nil
+}
+
+func (b *RoutedBalancer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	for _, route := range b.routes {
+		if matched, _ := path.Match(route.pattern, request.URL.Path); matched {
+			route.handler.ServeHTTP(response, request)
+			return
+		}
+	}
+	b.defaultHandler.ServeHTTP(response, request)
+}
+
+// Weighted round robin balancer.
+func NewRoundRobinBalancer(next http.Handler, upstreams []*Upstream) (http.Handler, error) {
+	loadBalancer, err := roundrobin.New(next)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create load balancer")
+	}
+	for _, upstream := range upstreams {
+		err := loadBalancer.UpsertServer(upstream.URL, roundrobin.Weight(upstream.Weight))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot add upstream '%s'", upstream.URL)
+		}
+	}
+	return loadBalancer, nil
+}
+
+// Least outstanding requests balancer. Number of outstanding requests of upstream
+// is scaled by its weight.
+type LeastConnBalancer struct {
+	next      http.Handler
+	mutex     sync.Mutex
+	upstreams []*leastConnUpstream
+	current   int
+}
+
+type leastConnUpstream struct {
+	url    *url.URL
+	weight int
+	active int
+}
+
+func NewLeastConnBalancer(next http.Handler, upstreams []*Upstream) *LeastConnBalancer {
+	balancer := &LeastConnBalancer{next: next}
+	for _, upstream := range upstreams {
+		balancer.upstreams = append(balancer.upstreams,
+			&leastConnUpstream{url: upstream.URL, weight: upstream.Weight})
+	}
+	return balancer
+}
+
+func (b *LeastConnBalancer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	upstream := b.acquire()
+	if upstream == nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer b.release(upstream)
+
+	forwardToUpstream(b.next, upstream.url, response, request)
+}
+
+func (b *LeastConnBalancer) acquire() *leastConnUpstream {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var best *leastConnUpstream
+	// Start search from next upstream on each call, so upstreams with equal load
+	// are used in turn.
+	for i := range b.upstreams {
+		upstream := b.upstreams[(b.current+i)%len(b.upstreams)]
+		if best == nil || upstream.active*best.weight < best.active*upstream.weight {
+			best = upstream
+		}
+	}
+	if best != nil {
+		best.active += 1
+		b.current = (b.current + 1) % len(b.upstreams)
+	}
+	return best
+}
+
+func (b *LeastConnBalancer) release(upstream *leastConnUpstream) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	upstream.active -= 1
+}
+
+// Consistent hashing balancer. Key of request is got by HashKeyFunc, so requests
+// with the same key are sent to the same upstream (as long as it is in the group).
+type HashKeyFunc func(*http.Request) string
+
+type HashBalancer struct {
+	next    http.Handler
+	key     HashKeyFunc
+	points  []uint32
+	targets map[uint32]*url.URL
+}
+
+func ParseHashKey(hashKey string) (HashKeyFunc, error) {
+	if hashKey == "path" {
+		return func(request *http.Request) string {
+			return request.URL.Path
+		}, nil
+	}
+
+	parts := strings.SplitN(hashKey, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.Errorf("incorrect hash key '%s'", hashKey)
+	}
+	name := parts[1]
+	switch parts[0] {
+	case "header":
+		return func(request *http.Request) string {
+			return request.Header.Get(name)
+		}, nil
+	case "cookie":
+		return func(request *http.Request) string {
+			if cookie, err := request.Cookie(name); err == nil {
+				return cookie.Value
+			}
+			return ""
+		}, nil
+	}
+	return nil, errors.Errorf("unknown source of hash key '%s'", parts[0])
+}
+
+func NewHashBalancer(next http.Handler, key HashKeyFunc, upstreams []*Upstream) *HashBalancer {
+	balancer := &HashBalancer{next: next, key: key, targets: make(map[uint32]*url.URL)}
+	for _, upstream := range upstreams {
+		for i := 0; i < upstream.Weight*hashReplicas; i += 1 {
+			point := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", upstream.URL, i)))
+			if _, exist := balancer.targets[point]; !exist {
+				balancer.targets[point] = upstream.URL
+				balancer.points = append(balancer.points, point)
+			}
+		}
+	}
+	sort.Sort(hashPoints(balancer.points))
+	return balancer
+}
+
+func (b *HashBalancer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if len(b.points) == 0 {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	hash := crc32.ChecksumIEEE([]byte(b.key(request)))
+	position := sort.Search(len(b.points), func(i int) bool {
+		return b.points[i] >= hash
+	})
+	if position == len(b.points) {
+		position = 0
+	}
+	forwardToUpstream(b.next, b.targets[b.points[position]], response, request)
+}
+
+type hashPoints []uint32
+
+func (p hashPoints) Len() int           { return len(p) }
+func (p hashPoints) Less(i, j int) bool { return p[i] < p[j] }
+func (p hashPoints) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Helpers
+func popParameter(query url.Values, name string) string {
+	value := query.Get(name)
+	query.Del(name)
+	return value
+}
+
+func forwardToUpstream(next http.Handler, upstream *url.URL,
+	response http.ResponseWriter, request *http.Request) {
+
+	upstreamRequest := *request
+	upstreamRequest.URL = utils.CopyURL(upstream)
+	next.ServeHTTP(response, &upstreamRequest)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for balancer tests.
+type upstreamRecorder struct {
+	hosts []string
+}
+
+func (r *upstreamRecorder) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	r.hosts = append(r.hosts, request.URL.Host)
+}
+
+func parseTestUpstreams(t *testing.T, upstreams ...string) []*Upstream {
+	result, err := ParseUpstreams(upstreams)
+	require.NoError(t, err, "cannot parse upstreams")
+	return result
+}
+
+func serveTestRequest(handler http.Handler, path string, header string) {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.Header.Set("X-User", header)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+}
+
+// Balancer tests.
+func TestParseUpstream(t *testing.T) {
+	upstream, err := ParseUpstream("http://host:8080/path?weight=3&key=value")
+	require.NoError(t, err, "cannot parse upstream")
+	require.Equal(t, 3, upstream.Weight, "incorrect weight of upstream")
+	require.Equal(t, "http://host:8080/path?key=value", upstream.URL.String(),
+		"settings must be removed from address")
+	require.Nil(t, upstream.TLS, "upstream without TLS settings must not have TLS config")
+
+	upstream, err = ParseUpstream("http://host:8080")
+	require.NoError(t, err, "cannot parse upstream")
+	require.Equal(t, defaultWeight, upstream.Weight, "incorrect default weight of upstream")
+
+	for _, address := range []string{"http://host?weight=0", "http://host?weight=-1",
+		"http://host?weight=heavy", "http://host?tls-ca=/not/exist", "http://%zz"} {
+
+		_, err := ParseUpstream(address)
+		require.Error(t, err, "incorrect upstream '%s' must not be parsed", address)
+	}
+}
+
+func TestParseUpstreamTLS(t *testing.T) {
+	dir := createTestTLSDir(t)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir, "upstream")
+
+	upstream, err := ParseUpstream("https://host:8443/path?key=value&tls-ca=" + certPath +
+		"&tls-cert=" + certPath + "&tls-key=" + keyPath + "&tls-server-name=upstream")
+	require.NoError(t, err, "cannot parse upstream")
+	require.Equal(t, "https://host:8443/path?key=value", upstream.URL.String(),
+		"TLS settings must be removed from address")
+	require.NotNil(t, upstream.TLS, "TLS config of upstream must be created")
+	require.Equal(t, "upstream", upstream.TLS.ServerName, "incorrect server name of upstream")
+	require.NotNil(t, upstream.TLS.RootCAs, "CA bundle of upstream must be loaded")
+	require.Len(t, upstream.TLS.Certificates, 1, "client certificate of upstream must be loaded")
+
+	upstream, err = ParseUpstream("https://host?tls-server-name=upstream")
+	require.NoError(t, err, "cannot parse upstream")
+	require.Equal(t, "https://host", upstream.URL.String(), "TLS settings must be removed from address")
+	require.Nil(t, upstream.TLS.RootCAs, "system CA bundle must be used by default")
+
+	none := filepath.Join(dir, "none.pem")
+	for _, address := range []string{"https://host?tls-ca=" + none, "https://host?tls-ca=" + keyPath,
+		"https://host?tls-cert=" + none + "&tls-key=" + keyPath, "https://host?tls-cert=" + certPath,
+		"https://host?tls-key=" + keyPath, "https://host?tls-cert=" + keyPath + "&tls-key=" + certPath} {
+
+		_, err := ParseUpstream(address)
+		require.Error(t, err, "upstream with incorrect TLS settings '%s' must not be parsed", address)
+	}
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	upstreams := parseTestUpstreams(t, "http://light", "http://heavy?weight=2")
+	balancer := NewLeastConnBalancer(&upstreamRecorder{}, upstreams)
+
+	// Outstanding requests are scaled by weight, so heavy upstream gets twice more.
+	acquired := map[string]int{}
+	for i := 0; i < 6; i += 1 {
+		acquired[balancer.acquire().url.Host] += 1
+	}
+	require.Equal(t, map[string]int{"light": 2, "heavy": 4}, acquired,
+		"incorrect distribution of outstanding requests")
+
+	// Released upstream is chosen for the next request.
+	light := balancer.upstreams[0]
+	balancer.release(light)
+	balancer.release(light)
+	require.Equal(t, "light", balancer.acquire().url.Host, "least loaded upstream must be chosen")
+
+	recorder := &upstreamRecorder{}
+	NewLeastConnBalancer(recorder, upstreams).ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Len(t, recorder.hosts, 1, "request must be forwarded")
+
+	response := httptest.NewRecorder()
+	NewLeastConnBalancer(recorder, nil).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusInternalServerError, response.Code, "balancer without upstreams must fail")
+}
+
+func TestHashBalancer(t *testing.T) {
+	upstreams := parseTestUpstreams(t, "http://first", "http://second", "http://third")
+	keyFunc, err := ParseHashKey("header:X-User")
+	require.NoError(t, err, "cannot parse hash key")
+	recorder := &upstreamRecorder{}
+	balancer := NewHashBalancer(recorder, keyFunc, upstreams)
+
+	users := []string{"alice", "bob", "carol", "dave", "eve", "frank", "grace", "heidi"}
+	for _, user := range users {
+		serveTestRequest(balancer, "/", user)
+	}
+	first := recorder.hosts
+	recorder.hosts = nil
+	for _, user := range users {
+		serveTestRequest(balancer, "/other", user)
+	}
+	require.Equal(t, first, recorder.hosts, "requests with the same key must be sent to the same upstream")
+
+	// Removed upstream moves only its own keys.
+	recorder.hosts = nil
+	balancer = NewHashBalancer(recorder, keyFunc, upstreams[:2])
+	for _, user := range users {
+		serveTestRequest(balancer, "/", user)
+	}
+	for i, host := range first {
+		if host != "third" {
+			require.Equal(t, host, recorder.hosts[i], "key of remained upstream must not be moved")
+		}
+	}
+
+	response := httptest.NewRecorder()
+	NewHashBalancer(recorder, keyFunc, nil).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusInternalServerError, response.Code, "balancer without upstreams must fail")
+}
+
+func TestParseHashKey(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/path", nil)
+	request.Header.Set("X-User", "alice")
+	request.AddCookie(&http.Cookie{Name: "session", Value: "secret"})
+
+	for hashKey, expected := range map[string]string{
+		"path": "/path", "header:X-User": "alice", "cookie:session": "secret", "cookie:none": ""} {
+
+		keyFunc, err := ParseHashKey(hashKey)
+		require.NoError(t, err, "cannot parse hash key '%s'", hashKey)
+		require.Equal(t, expected, keyFunc(request), "incorrect key of '%s'", hashKey)
+	}
+	for _, hashKey := range []string{"header", "header:", "query:name"} {
+		_, err := ParseHashKey(hashKey)
+		require.Error(t, err, "incorrect hash key '%s' must not be parsed", hashKey)
+	}
+}
+
+func TestRoutedBalancer(t *testing.T) {
+	upstreams := parseTestUpstreams(t, "http://first", "http://second", "http://third")
+	recorder := &upstreamRecorder{}
+	balancer, err := CreateRoutedBalancer(recorder, HashStrategy, "path",
+		[]string{"/users/*?hash-key=header:X-User"}, upstreams)
+	require.NoError(t, err, "cannot create balancer")
+
+	users := []string{"alice", "bob", "carol", "dave", "eve", "frank", "grace", "heidi"}
+	for _, user := range users {
+		serveTestRequest(balancer, "/orders", user)
+	}
+	for _, host := range recorder.hosts[1:] {
+		require.Equal(t, recorder.hosts[0], host, "default balancer must use key of path")
+	}
+
+	recorder.hosts = nil
+	for _, user := range users {
+		serveTestRequest(balancer, "/users/list", user)
+	}
+	hosts := map[string]bool{}
+	for _, host := range recorder.hosts {
+		hosts[host] = true
+	}
+	require.True(t, len(hosts) > 1, "balancer of route must use key of header")
+
+	for _, route := range []string{"[?balancer=hash", "/users?balancer=random", "/users?hash-key=query:id",
+		"/users?weight=2"} {
+
+		_, err := CreateRoutedBalancer(recorder, HashStrategy, "path", []string{route}, upstreams)
+		require.Error(t, err, "incorrect route '%s' must not be parsed", route)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/lyobzik/go-utils"
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	CallbackHeader  = "X-Leska-Callback"
+	SignatureHeader = "X-Leska-Signature"
+	TimestampHeader = "X-Leska-Timestamp"
+
+	DeliveredStatus = "delivered"
+	FailedStatus    = "failed"
+)
+
+type CallbackConfig struct {
+	AllowedHosts []string      `long:"allowed-host" description:"glob pattern of host of callback URL given by X-Leska-Callback header (callbacks are disabled by default)"`
+	SecretEnv    string        `long:"secret-env" description:"name of environment variable with secret to sign callbacks by HMAC-SHA256"`
+	Timeout      time.Duration `long:"timeout" default:"10s" description:"timeout of callback request"`
+	Retries      int           `long:"retries" default:"3" description:"number of retries of failed callback"`
+	RetryDelay   time.Duration `long:"retry-delay" default:"1s" description:"delay before the first retry of callback, it is doubled after each retry"`
+	MaxBodySize  int64         `long:"max-body-size" default:"4096" description:"maximum size of upstream response body in callback"`
+	QueueSize    int           `long:"queue-size" default:"10000" description:"maximum number of pending callbacks"`
+	Workers      int           `long:"workers" default:"4" description:"number of concurrent callback requests, failed callback is queued again after retry delay"`
+}
+
+// Notification is sent to callback URL when repeated request is delivered or
+// its tries run out.
+type Notification struct {
+	RequestID      string `json:"request_id"`
+	Status         string `json:"status"`
+	UpstreamStatus int    `json:"upstream_status"`
+	Attempts       int    `json:"attempts,omitempty"`
+	ResponseBody   string `json:"response_body"`
+	Truncated      bool   `json:"truncated"`
+}
+
+type callback struct {
+	url          string
+	notification *Notification
+	retry        int
+}
+
+// Notifier sends notifications to callback URLs of requests. Callback URL is
+// given by client in X-Leska-Callback header and is stored with request. Pending
+// callbacks are kept in memory, so they are lost on restart. Nil notifier is
+// disabled, in this case X-Leska-Callback header is not handled.
+type Notifier struct {
+	logger    *logging.Logger
+	config    CallbackConfig
+	secret    []byte
+	client    *http.Client
+	callbacks chan callback
+	stopper   *utils.Stopper
+}
+
+func NewNotifier(logger *logging.Logger, config CallbackConfig) (*Notifier, error) {
+	if len(config.AllowedHosts) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range config.AllowedHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "incorrect pattern of callback host '%s'", pattern)
+		}
+	}
+	notifier := &Notifier{
+		logger:    logger,
+		config:    config,
+		client:    &http.Client{Timeout: config.Timeout},
+		callbacks: make(chan callback, config.QueueSize),
+		stopper:   utils.NewStopper(),
+	}
+	if config.SecretEnv != "" {
+		secret, exist := os.LookupEnv(config.SecretEnv)
+		if !exist {
+			return nil, errors.Errorf("environment variable '%s' is not set", config.SecretEnv)
+		}
+		notifier.secret = []byte(secret)
+	}
+	return notifier, nil
+}
+
+func StartNotifier(logger *logging.Logger, config CallbackConfig) (*Notifier, error) {
+	notifier, err := NewNotifier(logger, config)
+	if err == nil && notifier != nil {
+		notifier.Start()
+	}
+	return notifier, err
+}
+
+// Start starts workers which send callbacks. Retry of failed callback waits for
+// its delay separately, so slow callback URL does not block the others.
+func (n *Notifier) Start() {
+	for i := 0; i < n.config.Workers || i == 0; i += 1 {
+		n.stopper.Add()
+		go n.notifyLoop()
+	}
+}
+
+// Stop sends pending callbacks (without retries) and stops notifier, callbacks
+// which wait for retry are dropped.
+func (n *Notifier) Stop() {
+	if n != nil {
+		n.stopper.Stop()
+		n.stopper.WaitDone()
+	}
+}
+
+// PopCallback removes X-Leska-Callback header and returns its value. Error is
+// returned if callback URL is incorrect or its host is not allowed.
+func (n *Notifier) PopCallback(header http.Header) (string, error) {
+	if n == nil {
+		return "", nil
+	}
+	callbackURL := header.Get(CallbackHeader)
+	header.Del(CallbackHeader)
+	if callbackURL == "" {
+		return "", nil
+	}
+
+	parsedURL, err := url.Parse(callbackURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return "", errors.Errorf("incorrect callback URL '%s'", callbackURL)
+	}
+	for _, pattern := range n.config.AllowedHosts {
+		if matched, _ := path.Match(pattern, parsedURL.Host); matched {
+			return callbackURL, nil
+		}
+	}
+	return "", errors.Errorf("host of callback URL '%s' is not allowed", callbackURL)
+}
+
+// BodySize returns size of response body which is read for callback, it exceeds
+// maximum body size, so truncation of body is detected.
+func (n *Notifier) BodySize() int64 {
+	return n.config.MaxBodySize + 1
+}
+
+// Notify queues notification about result of repeated request, it is dropped
+// if queue is full. Response body is truncated to maximum body size.
+func (n *Notifier) Notify(callbackURL string, requestLog *RequestLog, body []byte,
+	delivered bool) {
+
+	if n == nil || callbackURL == "" {
+		return
+	}
+	notification := &Notification{
+		RequestID:      requestLog.RequestID,
+		Status:         FailedStatus,
+		UpstreamStatus: requestLog.Status,
+		Attempts:       requestLog.Attempt,
+	}
+	if delivered {
+		notification.Status = DeliveredStatus
+	}
+	if int64(len(body)) > n.config.MaxBodySize {
+		body, notification.Truncated = body[:n.config.MaxBodySize], true
+	}
+	notification.ResponseBody = string(body)
+
+	select {
+	case n.callbacks <- callback{url: callbackURL, notification: notification}:
+	default:
+		n.logger.Errorf("callback of request %s is dropped, queue is full", requestLog.RequestID)
+	}
+}
+
+func (n *Notifier) notifyLoop() {
+	defer n.stopper.Done()
+
+	for {
+		select {
+		case <-n.stopper.Stopping:
+			n.sendPending()
+			return
+		case callback := <-n.callbacks:
+			n.sendOrRetry(callback)
+		}
+	}
+}
+
+func (n *Notifier) sendPending() {
+	for {
+		select {
+		case callback := <-n.callbacks:
+			n.send(callback)
+		default:
+			return
+		}
+	}
+}
+
+// sendOrRetry sends callback, failed callback is queued again after delay which
+// is doubled after each retry.
+func (n *Notifier) sendOrRetry(callback callback) {
+	err := n.send(callback)
+	if err == nil {
+		return
+	}
+	if callback.retry >= n.config.Retries {
+		n.logger.Errorf("cannot send callback of request %s to '%s': %v",
+			callback.notification.RequestID, callback.url, err)
+		return
+	}
+	delay := n.config.RetryDelay << uint(callback.retry)
+	callback.retry += 1
+	n.stopper.Add()
+	go n.retryAfter(callback, delay)
+}
+
+func (n *Notifier) retryAfter(callback callback, delay time.Duration) {
+	defer n.stopper.Done()
+
+	select {
+	case <-time.After(delay):
+	case <-n.stopper.Stopping:
+		return
+	}
+	select {
+	case n.callbacks <- callback:
+	default:
+		n.logger.Errorf("retry of callback of request %s is dropped, queue is full",
+			callback.notification.RequestID)
+	}
+}
+
+func (n *Notifier) send(callback callback) error {
+	body, err := json.Marshal(callback.notification)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode notification")
+	}
+	request, err := http.NewRequest(http.MethodPost, callback.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "cannot create callback request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(RequestIDHeader, callback.notification.RequestID)
+	if n.secret != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(TimestampHeader, timestamp)
+		request.Header.Set(SignatureHeader, "sha256="+n.sign(timestamp, body))
+	}
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || 300 <= response.StatusCode {
+		return errors.Errorf("callback returns %s", response.Status)
+	}
+	return nil
+}
+
+// sign returns HMAC-SHA256 of '<timestamp>.<body>', timestamp is signed to
+// prevent replay of old notifications.
+func (n *Notifier) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for callback tests.
+func startTestNotifier(t *testing.T, workers int, retryDelay time.Duration) *Notifier {
+	notifier, err := StartNotifier(logging.MustGetLogger("callback-test"), CallbackConfig{
+		AllowedHosts: []string{"*"},
+		Timeout:      5 * time.Second,
+		Retries:      2,
+		RetryDelay:   retryDelay,
+		MaxBodySize:  10,
+		QueueSize:    10,
+		Workers:      workers,
+	})
+	require.NoError(t, err, "cannot start notifier")
+	return notifier
+}
+
+func startTestCallbackServer(handler func(http.ResponseWriter, *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+func notifyTest(notifier *Notifier, url string, requestID string) {
+	notifier.Notify(url, &RequestLog{RequestID: requestID, Status: http.StatusOK, Attempt: 1}, nil, true)
+}
+
+func requireCallback(t *testing.T, received chan string, expected string, message string) {
+	select {
+	case requestID := <-received:
+		require.Equal(t, expected, requestID, message)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, message, "callback of '%s' is not received", expected)
+	}
+}
+
+// Callback tests.
+func TestNotifierSlowCallback(t *testing.T) {
+	release := make(chan struct{})
+	slow := startTestCallbackServer(func(response http.ResponseWriter, request *http.Request) {
+		<-release
+	})
+	defer slow.Close()
+	received := make(chan string, 10)
+	fast := startTestCallbackServer(func(response http.ResponseWriter, request *http.Request) {
+		received <- request.Header.Get(RequestIDHeader)
+	})
+	defer fast.Close()
+
+	notifier := startTestNotifier(t, 2, time.Second)
+	notifyTest(notifier, slow.URL, "slow")
+	notifyTest(notifier, fast.URL, "fast")
+	requireCallback(t, received, "fast", "slow callback must not block the others")
+	close(release)
+	notifier.Stop()
+}
+
+func TestNotifierRetry(t *testing.T) {
+	failed := make(chan string, 10)
+	failing := startTestCallbackServer(func(response http.ResponseWriter, request *http.Request) {
+		failed <- request.Header.Get(RequestIDHeader)
+		response.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer failing.Close()
+	received := make(chan string, 10)
+	fast := startTestCallbackServer(func(response http.ResponseWriter, request *http.Request) {
+		received <- request.Header.Get(RequestIDHeader)
+	})
+	defer fast.Close()
+
+	// The only worker sends the other callback while failed one waits for retry.
+	notifier := startTestNotifier(t, 1, 200*time.Millisecond)
+	notifyTest(notifier, failing.URL, "failed")
+	requireCallback(t, failed, "failed", "callback must be sent")
+	notifyTest(notifier, fast.URL, "fast")
+	requireCallback(t, received, "fast", "retry must not block the others")
+	requireCallback(t, failed, "failed", "failed callback must be retried")
+	requireCallback(t, failed, "failed", "failed callback must be retried")
+	select {
+	case <-failed:
+		require.Fail(t, "number of retries must be limited")
+	case <-time.After(time.Second):
+	}
+	notifier.Stop()
+}
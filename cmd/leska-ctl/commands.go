@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lyobzik/leska/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	timeFormat = "2006-01-02 15:04:05.000"
+)
+
+type ChunkArgs struct {
+	Chunk string `positional-arg-name:"chunk" required:"true" description:"path to chunk (without extension)"`
+}
+
+type ChunksArgs struct {
+	Chunks []string `positional-arg-name:"chunk" description:"paths to chunks (all chunks of storage by default)"`
+}
+
+// List chunks.
+type LsCommand struct{}
+
+func (c *LsCommand) Execute(args []string) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer writer.Flush()
+
+	fmt.Fprintln(writer, "CHUNK\tRECORDS\tACTIVE\tINDEX SIZE\tDATA SIZE")
+	return forEachChunk(nil, func(chunk *storage.Chunk) error {
+		indexSize, dataSize, err := getChunkSizes(chunk)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%d\n", chunk.Path, chunk.Index.Header.Length,
+			chunk.Index.Header.ActiveCount, indexSize, dataSize)
+		return nil
+	})
+}
+
+// Show index records of chunk.
+type ShowCommand struct {
+	Args ChunkArgs `positional-args:"yes" required:"yes"`
+}
+
+func (c *ShowCommand) Execute(args []string) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer writer.Flush()
+
+	return forEachChunk([]string{c.Args.Chunk}, func(chunk *storage.Chunk) error {
+		fmt.Fprintf(writer, "chunk: %s, records: %d, active: %d\n\n", chunk.Path,
+			chunk.Index.Header.Length, chunk.Index.Header.ActiveCount)
+		fmt.Fprintln(writer, "#\tTTL\tLAST TRY\tOFFSET\tSIZE\tKEY\tCOMPRESSION")
+		for i, record := range chunk.Index.Records {
+			fmt.Fprintf(writer, "%d\t%d\t%s\t%d\t%d\t%d\t%s\n", i, record.TTL,
+				record.LastTryTime().Format(timeFormat), record.Offset, record.Size, record.KeyID,
+				record.Compression)
+		}
+		return nil
+	})
+}
+
+// Dump stored requests.
+type CatCommand struct {
+	Records []int     `short:"r" long:"record" description:"number of record to dump (all records by default)"`
+	Active  bool      `short:"a" long:"active" description:"dump only active records"`
+	Args    ChunkArgs `positional-args:"yes" required:"yes"`
+}
+
+func (c *CatCommand) Execute(args []string) error {
+	return forEachChunk([]string{c.Args.Chunk}, func(chunk *storage.Chunk) error {
+		records := c.Records
+		if len(records) == 0 {
+			for i := range chunk.Index.Records {
+				records = append(records, i)
+			}
+		}
+		for _, i := range records {
+			if i < 0 || len(chunk.Index.Records) <= i {
+				return errors.Errorf("chunk has no record %d", i)
+			}
+			record := chunk.Index.Records[i]
+			if c.Active && record.TTL <= 0 {
+				continue
+			}
+			data, err := chunk.Restore(record)
+			if err != nil {
+				return errors.Wrapf(err, "cannot restore record %d", i)
+			}
+			fmt.Printf("### record %d (TTL %d, last try %s)\n", i, record.TTL,
+				record.LastTryTime().Format(timeFormat))
+			os.Stdout.Write(data)
+			fmt.Println()
+		}
+		return nil
+	})
+}
+
+// Check consistency of chunks.
+type VerifyCommand struct {
+	Args ChunksArgs `positional-args:"yes"`
+}
+
+func (c *VerifyCommand) Execute(args []string) error {
+	failedChunks := 0
+	err := forEachChunk(c.Args.Chunks, func(chunk *storage.Chunk) error {
+		problems := chunk.Verify()
+		if len(problems) == 0 {
+			fmt.Printf("%s: ok\n", chunk.Path)
+			return nil
+		}
+		failedChunks += 1
+		for _, problem := range problems {
+			fmt.Printf("%s: %v\n", chunk.Path, problem)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if failedChunks > 0 {
+		return errors.Errorf("%d chunks are inconsistent", failedChunks)
+	}
+	return nil
+}
+
+// Summarize storage.
+type StatsCommand struct{}
+
+func (c *StatsCommand) Execute(args []string) error {
+	var chunks, records, activeRecords, indexSize, dataSize, unreadableRecords int64
+	var stats storage.StoreStats
+	var oldestTry, newestTry time.Time
+
+	err := forEachChunk(nil, func(chunk *storage.Chunk) error {
+		chunkIndexSize, chunkDataSize, err := getChunkSizes(chunk)
+		if err != nil {
+			return err
+		}
+		chunks += 1
+		records += chunk.Index.Header.Length
+		activeRecords += chunk.Index.Header.ActiveCount
+		indexSize += chunkIndexSize
+		dataSize += chunkDataSize
+
+		for _, record := range chunk.Index.Records {
+			if record.TTL <= 0 {
+				continue
+			}
+			lastTry := record.LastTryTime()
+			if oldestTry.IsZero() || lastTry.Before(oldestTry) {
+				oldestTry = lastTry
+			}
+			if lastTry.After(newestTry) {
+				newestTry = lastTry
+			}
+			data, err := chunk.Restore(record)
+			if err != nil {
+				unreadableRecords += 1
+				continue
+			}
+			stats.Add(len(data), int(record.Size))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer writer.Flush()
+	fmt.Fprintf(writer, "storage:\t%s\n", options.Storage)
+	fmt.Fprintf(writer, "chunks:\t%d\n", chunks)
+	fmt.Fprintf(writer, "records:\t%d\n", records)
+	fmt.Fprintf(writer, "active records:\t%d\n", activeRecords)
+	fmt.Fprintf(writer, "unreadable active records:\t%d\n", unreadableRecords)
+	fmt.Fprintf(writer, "index size:\t%d\n", indexSize)
+	fmt.Fprintf(writer, "data size:\t%d\n", dataSize)
+	fmt.Fprintf(writer, "compression ratio of active records:\t%.2f\n", stats.CompressionRatio())
+	if activeRecords > 0 {
+		fmt.Fprintf(writer, "oldest last try:\t%s\n", oldestTry.Format(timeFormat))
+		fmt.Fprintf(writer, "newest last try:\t%s\n", newestTry.Format(timeFormat))
+	}
+	return nil
+}
+
+// Helpers
+func getChunkSizes(chunk *storage.Chunk) (int64, int64, error) {
+	indexStat, err := os.Stat(storage.GetIndexPath(chunk.Path))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "cannot get stat of index of chunk '%s'", chunk.Path)
+	}
+	dataStat, err := os.Stat(storage.GetDataPath(chunk.Path))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "cannot get stat of data of chunk '%s'", chunk.Path)
+	}
+	return indexStat.Size(), dataStat.Size(), nil
+}
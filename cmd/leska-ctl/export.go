@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lyobzik/leska/storage"
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	JSONLinesFormat = "jsonl"
+	HARFormat       = "har"
+
+	ActiveStatus   = "active"
+	InactiveStatus = "inactive"
+	AllStatus      = "all"
+)
+
+// Entry is exported request.
+type Entry struct {
+	Chunk   string      `json:"chunk,omitempty"`
+	Record  int         `json:"record"`
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Proto   string      `json:"proto"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"` // base64 encoded
+	TTL     int32       `json:"ttl"`
+	LastTry time.Time   `json:"last_try"`
+}
+
+func NewEntry(chunk *storage.Chunk, i int) (*Entry, error) {
+	record := chunk.Index.Records[i]
+	data, err := chunk.Restore(record)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot restore record %d of chunk '%s'", i, chunk.Path)
+	}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse record %d of chunk '%s'", i, chunk.Path)
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read body of record %d of chunk '%s'", i, chunk.Path)
+	}
+
+	requestUrl := *request.URL
+	requestUrl.Scheme, requestUrl.Host = "http", request.Host
+	return &Entry{
+		Chunk:   chunk.Path,
+		Record:  i,
+		Method:  request.Method,
+		URL:     requestUrl.String(),
+		Proto:   request.Proto,
+		Headers: request.Header,
+		Body:    base64.StdEncoding.EncodeToString(body),
+		TTL:     record.TTL,
+		LastTry: record.LastTryTime(),
+	}, nil
+}
+
+// Request creates HTTP request by entry.
+func (e *Entry) Request() (*http.Request, error) {
+	body, err := base64.StdEncoding.DecodeString(e.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode body")
+	}
+	request, err := http.NewRequest(e.Method, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+	for name, values := range e.Headers {
+		request.Header[name] = values
+	}
+	request.Header.Del("Content-Length")
+	request.Header.Del("Transfer-Encoding")
+	if _, exist := request.Header["User-Agent"]; !exist {
+		// Empty value prevents adding of default User-Agent on write.
+		request.Header["User-Agent"] = []string{""}
+	}
+	return request, nil
+}
+
+// Filter of exported and imported entries.
+type Filter struct {
+	Since  string `long:"since" description:"skip records with last try before this time (RFC 3339)"`
+	Until  string `long:"until" description:"skip records with last try after this time (RFC 3339)"`
+	Path   string `long:"path" description:"glob pattern of request path"`
+	Status string `long:"status" default:"active" choice:"active" choice:"inactive" choice:"all" description:"status of records"`
+}
+
+func (f *Filter) IsMatchedRecord(record storage.IndexRecord) (bool, error) {
+	switch f.Status {
+	case ActiveStatus:
+		if record.TTL <= 0 {
+			return false, nil
+		}
+	case InactiveStatus:
+		if record.TTL > 0 {
+			return false, nil
+		}
+	}
+	return f.isMatchedTime(record.LastTryTime())
+}
+
+func (f *Filter) IsMatchedEntry(entry *Entry) (bool, error) {
+	if matched, err := f.isMatchedTime(entry.LastTry); !matched || err != nil {
+		return matched, err
+	}
+	if f.Path == "" {
+		return true, nil
+	}
+	entryUrl, err := url.Parse(entry.URL)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot parse url '%s'", entry.URL)
+	}
+	matched, err := path.Match(f.Path, entryUrl.Path)
+	if err != nil {
+		return false, errors.Wrapf(err, "incorrect path pattern '%s'", f.Path)
+	}
+	return matched, nil
+}
+
+func (f *Filter) isMatchedTime(lastTry time.Time) (bool, error) {
+	if f.Since != "" {
+		since, err := time.Parse(time.RFC3339, f.Since)
+		if err != nil {
+			return false, errors.Wrapf(err, "incorrect time '%s'", f.Since)
+		}
+		if lastTry.Before(since) {
+			return false, nil
+		}
+	}
+	if f.Until != "" {
+		until, err := time.Parse(time.RFC3339, f.Until)
+		if err != nil {
+			return false, errors.Wrapf(err, "incorrect time '%s'", f.Until)
+		}
+		if lastTry.After(until) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Export records to HAR or JSON Lines.
+type ExportCommand struct {
+	Format string `short:"f" long:"format" default:"jsonl" choice:"jsonl" choice:"har" description:"format of exported records"`
+	Output string `short:"o" long:"output" description:"path to output file (stdout by default)"`
+	Filter
+	Args ChunksArgs `positional-args:"yes"`
+}
+
+func (c *ExportCommand) Execute(args []string) error {
+	output := os.Stdout
+	if c.Output != "" {
+		file, err := os.Create(c.Output)
+		if err != nil {
+			return errors.Wrapf(err, "cannot create output file '%s'", c.Output)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	entries := []*Entry{}
+	encoder := json.NewEncoder(output)
+	err := forEachChunk(c.Args.Chunks, func(chunk *storage.Chunk) error {
+		for i, record := range chunk.Index.Records {
+			if matched, err := c.IsMatchedRecord(record); !matched || err != nil {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			entry, err := NewEntry(chunk, i)
+			if err != nil {
+				return err
+			}
+			if matched, err := c.IsMatchedEntry(entry); !matched || err != nil {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if c.Format == HARFormat {
+				entries = append(entries, entry)
+			} else if err := encoder.Encode(entry); err != nil {
+				return errors.Wrap(err, "cannot write entry")
+			}
+		}
+		return nil
+	})
+	if err != nil || c.Format != HARFormat {
+		return err
+	}
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(NewHAR(entries))
+}
+
+// Import records from HAR or JSON Lines to storage.
+type ImportCommand struct {
+	Format string `short:"f" long:"format" choice:"jsonl" choice:"har" description:"format of imported records (by file extension by default)"`
+	TTL    int32  `long:"ttl" description:"TTL of imported records (TTL of exported records by default)"`
+	Filter
+	Args struct {
+		Files []string `positional-arg-name:"file" required:"1" description:"files to import"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *ImportCommand) Execute(args []string) error {
+	codec, err := createCodec()
+	if err != nil {
+		return err
+	}
+	logger, err := logging.GetLogger("leska-ctl")
+	if err != nil {
+		return errors.Wrap(err, "cannot create logger")
+	}
+	logging.SetLevel(logging.WARNING, "leska-ctl")
+	storer, err := storage.StartStorer(logger, options.Storage, 1, time.Hour, 1024, codec, nil)
+	if err != nil {
+		return err
+	}
+	defer storer.Stop()
+
+	for _, file := range c.Args.Files {
+		entries, err := c.readEntries(file)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := c.importEntry(storer, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *ImportCommand) readEntries(file string) ([]*Entry, error) {
+	input, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open file '%s'", file)
+	}
+	defer input.Close()
+
+	format := c.Format
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(file), ".")
+	}
+	switch format {
+	case HARFormat:
+		har := HAR{}
+		if err := json.NewDecoder(input).Decode(&har); err != nil {
+			return nil, errors.Wrapf(err, "cannot read HAR from '%s'", file)
+		}
+		return har.Entries()
+	case JSONLinesFormat:
+		entries := []*Entry{}
+		decoder := json.NewDecoder(input)
+		for {
+			entry := &Entry{}
+			if err := decoder.Decode(entry); err == io.EOF {
+				return entries, nil
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "cannot read entry from '%s'", file)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return nil, errors.Errorf("unknown format of file '%s'", file)
+}
+
+func (c *ImportCommand) importEntry(storer *storage.Storer, entry *Entry) error {
+	ttl := entry.TTL
+	if c.TTL > 0 {
+		ttl = c.TTL
+	}
+	record := storage.IndexRecord{TTL: ttl, LastTry: entry.LastTry}
+	if matched, err := c.IsMatchedRecord(record); !matched || err != nil {
+		return err
+	}
+	// Inactive record is never repeated, so it is imported only with new TTL.
+	if ttl <= 0 {
+		return nil
+	}
+	if matched, err := c.IsMatchedEntry(entry); !matched || err != nil {
+		return err
+	}
+
+	request, err := entry.Request()
+	if err != nil {
+		return errors.Wrapf(err, "cannot import record %d of chunk '%s'", entry.Record, entry.Chunk)
+	}
+	dataRecord := storage.DataRecord{Data: &importedRequest{request}, TTL: ttl, LastTry: entry.LastTry}
+	if err := storer.AddRecord(dataRecord); err != nil {
+		request.Body.Close()
+		return errors.Wrapf(err, "cannot import record %d of chunk '%s'", entry.Record, entry.Chunk)
+	}
+	return nil
+}
+
+// Imported request which is saved to storage in the same format as leska does.
+type importedRequest struct {
+	request *http.Request
+}
+
+func (r *importedRequest) Close() {
+	r.request.Body.Close()
+}
+
+func (r *importedRequest) Save(writer io.Writer) (int, error) {
+	buffer := bytes.NewBuffer([]byte{})
+	if err := r.request.Write(buffer); err != nil {
+		return 0, err
+	}
+	return writer.Write(buffer.Bytes())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	harVersion     = "1.2"
+	base64Encoding = "base64"
+)
+
+// Subset of HTTP Archive format (HAR 1.2) which is enough to keep stored requests.
+// Leska-specific values are kept in fields with '_' prefix.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator HARCreator  `json:"creator"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            int         `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Chunk           string      `json:"_chunk,omitempty"`
+	Record          int         `json:"_record"`
+	TTL             int32       `json:"_ttl"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding"`
+}
+
+// Requests are not sent by export, so response is empty.
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type HARTimings struct {
+	Send    int `json:"send"`
+	Wait    int `json:"wait"`
+	Receive int `json:"receive"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func NewHAR(entries []*Entry) *HAR {
+	har := &HAR{Log: HARLog{
+		Version: harVersion,
+		Creator: HARCreator{Name: "leska-ctl", Version: "1"},
+		Entries: []*HAREntry{},
+	}}
+	for _, entry := range entries {
+		har.Log.Entries = append(har.Log.Entries, newHAREntry(entry))
+	}
+	return har
+}
+
+func (h *HAR) Entries() ([]*Entry, error) {
+	entries := []*Entry{}
+	for i, harEntry := range h.Log.Entries {
+		entry := &Entry{
+			Chunk:   harEntry.Chunk,
+			Record:  harEntry.Record,
+			Method:  harEntry.Request.Method,
+			URL:     harEntry.Request.URL,
+			Proto:   harEntry.Request.HTTPVersion,
+			Headers: http.Header{},
+			TTL:     harEntry.TTL,
+			LastTry: harEntry.StartedDateTime,
+		}
+		for _, header := range harEntry.Request.Headers {
+			entry.Headers.Add(header.Name, header.Value)
+		}
+		if postData := harEntry.Request.PostData; postData != nil {
+			if postData.Encoding != base64Encoding {
+				return nil, errors.Errorf("body of HAR entry %d is not base64 encoded", i)
+			}
+			entry.Body = postData.Text
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func newHAREntry(entry *Entry) *HAREntry {
+	harEntry := &HAREntry{
+		StartedDateTime: entry.LastTry,
+		Request: HARRequest{
+			Method:      entry.Method,
+			URL:         entry.URL,
+			HTTPVersion: entry.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     []HARNameValue{},
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: HARResponse{
+			Cookies: []HARNameValue{},
+			Headers: []HARNameValue{},
+		},
+		Chunk:  entry.Chunk,
+		Record: entry.Record,
+		TTL:    entry.TTL,
+	}
+	for name, values := range entry.Headers {
+		for _, value := range values {
+			harEntry.Request.Headers = append(harEntry.Request.Headers,
+				HARNameValue{Name: name, Value: value})
+		}
+	}
+	if entry.Body != "" {
+		harEntry.Request.PostData = &HARPostData{
+			MimeType: entry.Headers.Get("Content-Type"),
+			Text:     entry.Body,
+			Encoding: base64Encoding,
+		}
+	}
+	return harEntry
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/lyobzik/leska/storage"
+	"github.com/pkg/errors"
+)
+
+// Options which are common for all commands.
+type Options struct {
+	Storage string `short:"s" long:"storage" default:"storage" description:"path to storage directory"`
+	KeyFile string `long:"key-file" description:"path to file with keys to decrypt stored requests"`
+	KeyEnv  string `long:"key-env" description:"name of environment variable with keys to decrypt stored requests"`
+}
+
+var options Options
+
+func main() {
+	parser := flags.NewParser(&options, flags.Default)
+	parser.AddCommand("ls", "list chunks",
+		"List finalized chunks of storage with record counts and sizes.", &LsCommand{})
+	parser.AddCommand("show", "show records of chunk",
+		"Print index records of chunk.", &ShowCommand{})
+	parser.AddCommand("cat", "dump stored requests",
+		"Print stored HTTP requests of chunk.", &CatCommand{})
+	parser.AddCommand("verify", "check chunks consistency",
+		"Check consistency of index and data of chunks.", &VerifyCommand{})
+	parser.AddCommand("stats", "summarize storage",
+		"Print summary of whole storage.", &StatsCommand{})
+	parser.AddCommand("export", "export stored requests",
+		"Export stored requests to HAR or JSON Lines.", &ExportCommand{})
+	parser.AddCommand("import", "import requests to storage",
+		"Import requests from HAR or JSON Lines to storage.", &ImportCommand{})
+
+	if _, err := parser.Parse(); err != nil {
+		if flagsError, converted := err.(*flags.Error); !converted || flagsError.Type != flags.ErrHelp {
+			os.Exit(1)
+		}
+	}
+}
+
+// Helpers
+func createCodec() (*storage.Codec, error) {
+	keys := []string{}
+	if options.KeyFile != "" {
+		data, err := ioutil.ReadFile(options.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read keys from '%s'", options.KeyFile)
+		}
+		keys = append(keys, string(data))
+	}
+	if options.KeyEnv != "" {
+		keys = append(keys, os.Getenv(options.KeyEnv))
+	}
+	if len(keys) == 0 {
+		return storage.NewCodec(nil, storage.NoCompression, 0), nil
+	}
+
+	keyring, err := storage.ParseKeyring(strings.Join(keys, "\n"), storage.NoKeyID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse encryption keys")
+	}
+	return storage.NewCodec(keyring, storage.NoCompression, 0), nil
+}
+
+type ChunkHandler func(*storage.Chunk) error
+
+// forEachChunk opens chunks in read-only mode and calls handler for each of them.
+// If chunks are not set all finalized chunks of storage are used.
+func forEachChunk(chunks []string, handler ChunkHandler) error {
+	codec, err := createCodec()
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		if chunks, err = storage.ListChunks(options.Storage); err != nil {
+			return err
+		}
+	}
+	for _, chunkPath := range chunks {
+		if err := handleChunk(chunkPath, codec, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleChunk(chunkPath string, codec *storage.Codec, handler ChunkHandler) error {
+	chunk, err := storage.OpenChunkReadOnly(normalizeChunkPath(chunkPath), codec)
+	if err != nil {
+		return err
+	}
+	defer chunk.Close()
+	return handler(chunk)
+}
+
+// normalizeChunkPath allows to use path to index or data file as chunk path.
+func normalizeChunkPath(chunkPath string) string {
+	chunkPath = strings.TrimSuffix(chunkPath, storage.GetIndexPath(""))
+	return strings.TrimSuffix(chunkPath, storage.GetDataPath(""))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+// DestinationHeader keeps name of fan-out destination of stored request, it is
+// removed before request is repeated.
+const DestinationHeader = "X-Leska-Destination"
+
+var destinationNamePattern = regexp.MustCompile("^[0-9a-zA-Z]+$")
+
+type FanoutConfig struct {
+	Destinations []string `long:"destination" description:"destination of fan-out delivery ('<name>=<URL>', name consists of letters and digits), settings of upstream are set by query parameters"`
+	Routes       []string `long:"route" description:"glob pattern of path of requests which are delivered to all destinations, destinations of route may be limited: '<pattern>=<name>,<name>'"`
+}
+
+type fanoutDestination struct {
+	name          string
+	handler       http.Handler
+	replayHandler http.Handler
+}
+
+type fanoutRoute struct {
+	pattern      string
+	destinations []*fanoutDestination
+}
+
+// FanoutResult is result of delivery of request to destinations.
+type FanoutResult struct {
+	Failed    []string       // names of destinations which do not accept request
+	Delivered map[string]int // statuses of destinations which accept request
+}
+
+// Fanout delivers requests of its routes to all destinations instead of upstream
+// group. Request is stored separately for each failed destination, so only failed
+// destinations are repeated. Nil fanout is disabled.
+type Fanout struct {
+	destinations map[string]*fanoutDestination
+	names        []string
+	routes       []fanoutRoute
+}
+
+func NewFanout(logger *logging.Logger, config FanoutConfig, forwardConfig TransportConfig,
+	replayConfig TransportConfig) (*Fanout, error) {
+
+	if len(config.Destinations) == 0 {
+		if len(config.Routes) > 0 {
+			return nil, errors.New("fan-out routes require destinations")
+		}
+		return nil, nil
+	}
+	fanout := &Fanout{destinations: make(map[string]*fanoutDestination)}
+	for _, destination := range config.Destinations {
+		parts := strings.SplitN(destination, "=", 2)
+		if len(parts) != 2 || !destinationNamePattern.MatchString(parts[0]) {
+			return nil, errors.Errorf("incorrect fan-out destination '%s'", destination)
+		}
+		if _, exist := fanout.destinations[parts[0]]; exist {
+			return nil, errors.Errorf("fan-out destination '%s' is duplicated", parts[0])
+		}
+		upstream, err := ParseUpstream(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		upstreams := []*Upstream{upstream}
+		handler, err := CreateForwarder(logger, upstreams, RoundRobinStrategy, "", nil,
+			CreateTransport(forwardConfig, upstreams))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create forwarder of destination '%s'", parts[0])
+		}
+		replayHandler, err := CreateForwarder(logger, upstreams, RoundRobinStrategy, "", nil,
+			NewHostTransport(CreateTransport(replayConfig, upstreams)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create forwarder of destination '%s'", parts[0])
+		}
+		fanout.destinations[parts[0]] = &fanoutDestination{
+			name:          parts[0],
+			handler:       handler,
+			replayHandler: replayHandler,
+		}
+		fanout.names = append(fanout.names, parts[0])
+	}
+
+	for _, route := range config.Routes {
+		parts := strings.SplitN(route, "=", 2)
+		if _, err := path.Match(parts[0], ""); err != nil {
+			return nil, errors.Wrapf(err, "incorrect pattern of fan-out route '%s'", route)
+		}
+		names := fanout.names
+		if len(parts) == 2 {
+			names = strings.Split(parts[1], ",")
+		}
+		parsedRoute := fanoutRoute{pattern: parts[0]}
+		for _, name := range names {
+			destination, exist := fanout.destinations[name]
+			if !exist {
+				return nil, errors.Errorf("unknown destination '%s' of fan-out route '%s'", name, route)
+			}
+			parsedRoute.destinations = append(parsedRoute.destinations, destination)
+		}
+		fanout.routes = append(fanout.routes, parsedRoute)
+	}
+	return fanout, nil
+}
+
+// Names returns names of all destinations.
+func (f *Fanout) Names() []string {
+	if f == nil {
+		return nil
+	}
+	return f.names
+}
+
+// Select returns destinations of request, it returns nil if request is not
+// delivered by fan-out.
+func (f *Fanout) Select(request *http.Request) []*fanoutDestination {
+	if f == nil {
+		return nil
+	}
+	for _, route := range f.routes {
+		if matched, _ := path.Match(route.pattern, request.URL.Path); matched {
+			return route.destinations
+		}
+	}
+	return nil
+}
+
+// Deliver sends request to destinations concurrently. It returns response of the
+// first failed destination or response of the first destination if all of them
+// accept request.
+func (f *Fanout) Deliver(request *Request, requestLog *RequestLog,
+	destinations []*fanoutDestination) (*Response, *FanoutResult, error) {
+
+	responses := make([]*Response, len(destinations))
+	logs := make([]RequestLog, len(destinations))
+	defer func() {
+		for _, response := range responses {
+			if response != nil {
+				response.Close()
+			}
+		}
+	}()
+
+	var waiter sync.WaitGroup
+	for i, destination := range destinations {
+		requestCopy, err := request.Clone()
+		if err != nil {
+			waiter.Wait()
+			return nil, nil, err
+		}
+		if responses[i], err = NewResponse(); err != nil {
+			requestCopy.Close()
+			waiter.Wait()
+			return nil, nil, errors.Wrap(err, "cannot create response")
+		}
+		logs[i] = RequestLog{RequestID: requestLog.RequestID, Attempt: requestLog.Attempt}
+		waiter.Add(1)
+		go func(i int, destination *fanoutDestination) {
+			defer waiter.Done()
+			defer requestCopy.Close()
+			ServeRequest(destination.handler, responses[i], requestCopy, &logs[i])
+		}(i, destination)
+	}
+	waiter.Wait()
+
+	result := &FanoutResult{Delivered: make(map[string]int)}
+	chosen := 0
+	for i, destination := range destinations {
+		if responses[i].IsFailed() {
+			if len(result.Failed) == 0 {
+				chosen = i
+			}
+			result.Failed = append(result.Failed, destination.name)
+		} else {
+			result.Delivered[destination.name] = responses[i].code
+		}
+		if logs[i].Duration > requestLog.Duration {
+			requestLog.Duration = logs[i].Duration
+		}
+	}
+	requestLog.Upstream = destinations[chosen].name
+	requestLog.Status = responses[chosen].code
+
+	response := responses[chosen]
+	responses[chosen] = nil
+	return response, result, nil
+}
+
+// ReplayHandler returns handler of repeated requests which sends requests of
+// fan-out destinations to these destinations and other requests to handler.
+func (f *Fanout) ReplayHandler(handler http.Handler) http.Handler {
+	if f == nil {
+		return handler
+	}
+	return &fanoutReplayHandler{fanout: f, handler: handler}
+}
+
+type fanoutReplayHandler struct {
+	fanout  *Fanout
+	handler http.Handler
+}
+
+func (h *fanoutReplayHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	name := request.Header.Get(DestinationHeader)
+	if name == "" {
+		h.handler.ServeHTTP(response, request)
+		return
+	}
+	request.Header.Del(DestinationHeader)
+	destination, exist := h.fanout.destinations[name]
+	if !exist {
+		// Destination is removed from config, request is failed until its tries run out.
+		http.Error(response, "unknown fan-out destination '"+name+"'", http.StatusBadGateway)
+		return
+	}
+	setLogUpstream(request, name)
+	destination.replayHandler.ServeHTTP(response, request)
+}
+
+// Helpers
+// destinationTrackingID returns tracking id of request to fan-out destination.
+func destinationTrackingID(trackingID string, destination string) string {
+	return trackingID + "-" + destination
+}
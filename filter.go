@@ -0,0 +1,261 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FallbackQueueMode   = "fallback"
+	WriteAheadQueueMode = "write-ahead"
+	PureQueueMode       = "queue"
+
+	methodParameter      = "method"
+	pathParameter        = "path"
+	pathRegexParameter   = "path-regex"
+	contentTypeParameter = "content-type"
+	maxSizeParameter     = "max-size"
+	streamingParameter   = "streaming"
+)
+
+type QueueConfig struct {
+	Methods []string `long:"method" default:"POST" default:"PUT" default:"PATCH" default:"DELETE" description:"method of failed requests which may be queued"`
+	Allow   []string `long:"allow" description:"rule of failed requests which may be queued, conditions are set by query parameters: method, path (glob), path-regex, content-type (glob), header (presence), max-size (bytes, Content-Length is known and does not exceed it), streaming (true or false, body is chunked or its length is unknown), e.g. 'path=/orders/*&content-type=application/json' (all requests by default)"`
+	Deny    []string `long:"deny" description:"rule of failed requests which are never queued (format of allow rule), e.g. 'content-type=multipart/*' or 'streaming=true'"`
+	Mode    string   `long:"mode" default:"fallback" choice:"fallback" choice:"write-ahead" choice:"queue" description:"queue mode: 'fallback' (request is stored if upstream fails), 'write-ahead' (request is stored before forwarding and is removed when it is delivered, so it is not lost on crash; requests of fan-out routes are stored after failure as in fallback mode), 'queue' (request is stored and acknowledged without forwarding, it is delivered by repeater)"`
+	Routes  []string `long:"route" description:"queue mode of requests which path matches glob pattern ('<pattern>=<mode>')"`
+}
+
+// filterRule matches request if all its conditions are satisfied, condition
+// is satisfied if request matches any of its values.
+type filterRule struct {
+	methods      []string
+	paths        []string
+	pathRegexps  []*regexp.Regexp
+	contentTypes []string
+	headers      []string
+	maxSize      int64 // -1 if it is not set
+	streaming    []bool
+}
+
+// QueueFilter decides if failed request may be queued, request which cannot be
+// queued gets upstream error. Request is queued if its method is allowed, it
+// matches any allow rule and does not match any deny rule.
+type QueueFilter struct {
+	methods []string
+	allow   []*filterRule
+	deny    []*filterRule
+	mode    string
+	routes  []queueRoute
+}
+
+type queueRoute struct {
+	pattern string
+	mode    string
+}
+
+func NewQueueFilter(config QueueConfig) (*QueueFilter, error) {
+	filter := &QueueFilter{mode: config.Mode}
+	for _, method := range config.Methods {
+		filter.methods = append(filter.methods, strings.ToUpper(method))
+	}
+	var err error
+	if filter.allow, err = parseFilterRules(config.Allow); err != nil {
+		return nil, errors.Wrap(err, "incorrect allow rule")
+	}
+	if filter.deny, err = parseFilterRules(config.Deny); err != nil {
+		return nil, errors.Wrap(err, "incorrect deny rule")
+	}
+	for _, route := range config.Routes {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || !isQueueMode(parts[1]) {
+			return nil, errors.Errorf("incorrect queue route '%s'", route)
+		}
+		if _, err := path.Match(parts[0], ""); err != nil {
+			return nil, errors.Wrapf(err, "incorrect pattern of queue route '%s'", route)
+		}
+		filter.routes = append(filter.routes, queueRoute{pattern: parts[0], mode: parts[1]})
+	}
+	return filter, nil
+}
+
+// Mode returns queue mode of request, the first matched route is used.
+func (f *QueueFilter) Mode(request *http.Request) string {
+	for _, route := range f.routes {
+		if matched, _ := path.Match(route.pattern, request.URL.Path); matched {
+			return route.mode
+		}
+	}
+	return f.mode
+}
+
+func (f *QueueFilter) IsQueueable(request *http.Request) bool {
+	if !containsString(f.methods, request.Method) {
+		return false
+	}
+	for _, rule := range f.deny {
+		if rule.match(request) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, rule := range f.allow {
+		if rule.match(request) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *filterRule) match(request *http.Request) bool {
+	if len(r.methods) > 0 && !containsString(r.methods, request.Method) {
+		return false
+	}
+	if len(r.paths) > 0 && !matchAny(r.paths, request.URL.Path) {
+		return false
+	}
+	if len(r.pathRegexps) > 0 {
+		matched := false
+		for _, pathRegexp := range r.pathRegexps {
+			matched = matched || pathRegexp.MatchString(request.URL.Path)
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.contentTypes) > 0 {
+		contentType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+		if !matchAny(r.contentTypes, contentType) {
+			return false
+		}
+	}
+	// Body of unknown length may exceed any size.
+	if r.maxSize >= 0 && (request.ContentLength < 0 || r.maxSize < request.ContentLength) {
+		return false
+	}
+	if len(r.streaming) > 0 {
+		streaming := request.ContentLength < 0 || containsString(request.TransferEncoding, "chunked")
+		matched := false
+		for _, value := range r.streaming {
+			matched = matched || value == streaming
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, header := range r.headers {
+		if _, exist := request.Header[http.CanonicalHeaderKey(header)]; exist {
+			return true
+		}
+	}
+	return len(r.headers) == 0
+}
+
+// Helpers
+func parseFilterRules(rules []string) ([]*filterRule, error) {
+	result := make([]*filterRule, 0, len(rules))
+	for _, rule := range rules {
+		parsedRule, err := parseFilterRule(rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse rule '%s'", rule)
+		}
+		result = append(result, parsedRule)
+	}
+	return result, nil
+}
+
+func parseFilterRule(rule string) (*filterRule, error) {
+	// Values are not decoded by url.ParseQuery, because '+' is often used in
+	// regular expressions.
+	query := make(url.Values)
+	for _, condition := range strings.Split(rule, "&") {
+		parts := strings.SplitN(condition, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("incorrect condition '%s'", condition)
+		}
+		value, err := url.PathUnescape(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "incorrect condition '%s'", condition)
+		}
+		query.Add(parts[0], value)
+	}
+	result := &filterRule{
+		paths:        query[pathParameter],
+		contentTypes: query[contentTypeParameter],
+		headers:      query[headerParameter],
+		maxSize:      -1,
+	}
+	for _, method := range query[methodParameter] {
+		result.methods = append(result.methods, strings.ToUpper(method))
+	}
+	for _, patterns := range [][]string{result.paths, result.contentTypes} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "incorrect pattern '%s'", pattern)
+			}
+		}
+	}
+	for _, expression := range query[pathRegexParameter] {
+		pathRegexp, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, errors.Wrapf(err, "incorrect regular expression '%s'", expression)
+		}
+		result.pathRegexps = append(result.pathRegexps, pathRegexp)
+	}
+	for _, value := range query[maxSizeParameter] {
+		maxSize, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxSize < 0 {
+			return nil, errors.Errorf("incorrect maximum size '%s'", value)
+		}
+		if maxSize > result.maxSize {
+			result.maxSize = maxSize
+		}
+	}
+	for _, value := range query[streamingParameter] {
+		streaming, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.Errorf("incorrect streaming condition '%s'", value)
+		}
+		result.streaming = append(result.streaming, streaming)
+	}
+	for name := range query {
+		switch name {
+		case methodParameter, pathParameter, pathRegexParameter, contentTypeParameter, headerParameter,
+			maxSizeParameter, streamingParameter:
+		default:
+			return nil, errors.Errorf("unknown condition '%s'", name)
+		}
+	}
+	return result, nil
+}
+
+func isQueueMode(mode string) bool {
+	return mode == FallbackQueueMode || mode == WriteAheadQueueMode || mode == PureQueueMode
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for queue filter tests.
+type filterTestRequest struct {
+	method        string
+	path          string
+	contentType   string
+	header        string
+	contentLength int64
+	chunked       bool
+}
+
+func (r filterTestRequest) create() *http.Request {
+	request := httptest.NewRequest(r.method, r.path, strings.NewReader("body"))
+	if r.contentType != "" {
+		request.Header.Set("Content-Type", r.contentType)
+	}
+	if r.header != "" {
+		request.Header.Set(r.header, "value")
+	}
+	request.ContentLength = r.contentLength
+	if r.chunked {
+		request.ContentLength = -1
+		request.TransferEncoding = []string{"chunked"}
+	}
+	return request
+}
+
+// Queue filter tests.
+func TestParseFilterRule(t *testing.T) {
+	rule, err := parseFilterRule("method=post&path=/orders/*&path-regex=^/v[0-9]+/&" +
+		"content-type=application/*&header=X-Queue&max-size=100&max-size=1000&streaming=false")
+	require.NoError(t, err, "cannot parse rule")
+	require.Equal(t, []string{"POST"}, rule.methods, "method must be upper case")
+	require.Equal(t, []string{"/orders/*"}, rule.paths, "incorrect paths of rule")
+	require.Len(t, rule.pathRegexps, 1, "incorrect regular expressions of rule")
+	require.Equal(t, "^/v[0-9]+/", rule.pathRegexps[0].String(), "regular expression must not be decoded")
+	require.Equal(t, []string{"application/*"}, rule.contentTypes, "incorrect content types of rule")
+	require.Equal(t, []string{"X-Queue"}, rule.headers, "incorrect headers of rule")
+	require.EqualValues(t, 1000, rule.maxSize, "the largest maximum size must be used")
+	require.Equal(t, []bool{false}, rule.streaming, "incorrect streaming condition of rule")
+
+	rule, err = parseFilterRule("path-regex=^/a+b$&path=/with%20space")
+	require.NoError(t, err, "cannot parse rule")
+	require.Equal(t, "^/a+b$", rule.pathRegexps[0].String(), "'+' must be kept in regular expression")
+	require.Equal(t, []string{"/with space"}, rule.paths, "value must be unescaped")
+	require.EqualValues(t, -1, rule.maxSize, "maximum size must not be set")
+
+	for _, incorrectRule := range []string{"path", "path=[", "content-type=[", "path-regex=(",
+		"max-size=big", "max-size=-1", "streaming=maybe", "unknown=value", "path=%zz"} {
+
+		_, err := parseFilterRule(incorrectRule)
+		require.Error(t, err, "incorrect rule '%s' must not be parsed", incorrectRule)
+	}
+}
+
+func TestIsQueueable(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    QueueConfig
+		request   filterTestRequest
+		queueable bool
+	}{
+		{"allowed method", QueueConfig{Methods: []string{"post"}},
+			filterTestRequest{method: "POST", path: "/", contentLength: 4}, true},
+		{"not allowed method", QueueConfig{Methods: []string{"POST"}},
+			filterTestRequest{method: "GET", path: "/", contentLength: 4}, false},
+		{"allowed path", QueueConfig{Methods: []string{"POST"}, Allow: []string{"path=/orders/*"}},
+			filterTestRequest{method: "POST", path: "/orders/1", contentLength: 4}, true},
+		{"not allowed path", QueueConfig{Methods: []string{"POST"}, Allow: []string{"path=/orders/*"}},
+			filterTestRequest{method: "POST", path: "/users/1", contentLength: 4}, false},
+		{"any allow rule", QueueConfig{Methods: []string{"POST"},
+			Allow: []string{"path=/orders/*", "path-regex=^/users/[0-9]+$"}},
+			filterTestRequest{method: "POST", path: "/users/1", contentLength: 4}, true},
+		{"all conditions of rule", QueueConfig{Methods: []string{"POST"},
+			Allow: []string{"path=/orders/*&content-type=application/json"}},
+			filterTestRequest{method: "POST", path: "/orders/1", contentType: "text/plain", contentLength: 4}, false},
+		{"content type with parameters", QueueConfig{Methods: []string{"POST"},
+			Allow: []string{"content-type=application/json"}},
+			filterTestRequest{method: "POST", path: "/", contentType: "application/json; charset=utf-8",
+				contentLength: 4}, true},
+		{"denied header", QueueConfig{Methods: []string{"POST"}, Deny: []string{"header=X-No-Queue"}},
+			filterTestRequest{method: "POST", path: "/", header: "X-No-Queue", contentLength: 4}, false},
+		{"deny before allow", QueueConfig{Methods: []string{"POST"}, Allow: []string{"path=/*"},
+			Deny: []string{"content-type=multipart/*"}},
+			filterTestRequest{method: "POST", path: "/upload", contentType: "multipart/form-data",
+				contentLength: 4}, false},
+		{"size within maximum", QueueConfig{Methods: []string{"POST"}, Allow: []string{"max-size=4"}},
+			filterTestRequest{method: "POST", path: "/", contentLength: 4}, true},
+		{"size exceeds maximum", QueueConfig{Methods: []string{"POST"}, Allow: []string{"max-size=3"}},
+			filterTestRequest{method: "POST", path: "/", contentLength: 4}, false},
+		{"unknown size exceeds maximum", QueueConfig{Methods: []string{"POST"}, Allow: []string{"max-size=1000"}},
+			filterTestRequest{method: "POST", path: "/", chunked: true}, false},
+		{"denied streaming", QueueConfig{Methods: []string{"POST"}, Deny: []string{"streaming=true"}},
+			filterTestRequest{method: "POST", path: "/", chunked: true}, false},
+		{"not streaming", QueueConfig{Methods: []string{"POST"}, Deny: []string{"streaming=true"}},
+			filterTestRequest{method: "POST", path: "/", contentLength: 4}, true},
+	}
+	for _, test := range tests {
+		filter, err := NewQueueFilter(test.config)
+		require.NoError(t, err, "cannot create filter of test '%s'", test.name)
+		require.Equal(t, test.queueable, filter.IsQueueable(test.request.create()),
+			"incorrect result of test '%s'", test.name)
+	}
+}
+
+func TestQueueFilterMode(t *testing.T) {
+	filter, err := NewQueueFilter(QueueConfig{Mode: FallbackQueueMode,
+		Routes: []string{"/orders/*=write-ahead", "/*=queue"}})
+	require.NoError(t, err, "cannot create filter")
+
+	request := filterTestRequest{method: "POST", path: "/orders/1"}
+	require.Equal(t, WriteAheadQueueMode, filter.Mode(request.create()), "the first matched route must be used")
+	request.path = "/users"
+	require.Equal(t, PureQueueMode, filter.Mode(request.create()), "incorrect mode of route")
+	request.path = "/users/1"
+	require.Equal(t, FallbackQueueMode, filter.Mode(request.create()), "default mode must be used")
+
+	for _, route := range []string{"/orders", "/orders=unknown", "[=queue"} {
+		_, err := NewQueueFilter(QueueConfig{Mode: FallbackQueueMode, Routes: []string{route}})
+		require.Error(t, err, "incorrect route '%s' must not be parsed", route)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lyobzik/leska/storage"
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+type HealthConfig struct {
+	Address        string `long:"address" description:"listen address of /healthz and /readyz endpoints (endpoints are disabled by default)"`
+	MaxStorageSize int64  `long:"max-storage-size" default:"0" description:"maximum size of storage directory in bytes, leska is not ready if it is exceeded (0 - unlimited)"`
+}
+
+// UpstreamMonitor keeps results of last requests to upstreams. Transports of
+// live and repeated requests are wrapped by the same monitor.
+type UpstreamMonitor struct {
+	mutex     sync.Mutex
+	upstreams []string
+	states    map[string]*UpstreamState
+}
+
+type UpstreamState struct {
+	Upstream    string    `json:"upstream"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+	Failures    int       `json:"failures"` // number of failures since last success
+}
+
+func NewUpstreamMonitor(upstreams []*Upstream) *UpstreamMonitor {
+	monitor := &UpstreamMonitor{states: make(map[string]*UpstreamState)}
+	for _, upstream := range upstreams {
+		key := getUpstreamKey(upstream.URL)
+		if _, exist := monitor.states[key]; !exist {
+			monitor.upstreams = append(monitor.upstreams, key)
+			monitor.states[key] = &UpstreamState{Upstream: key}
+		}
+	}
+	return monitor
+}
+
+// Wrap returns transport which reports results of requests to monitor. Transport
+// errors and 5xx-responses are treated as failures.
+func (m *UpstreamMonitor) Wrap(transport http.RoundTripper) http.RoundTripper {
+	return &monitoredTransport{transport: transport, monitor: m}
+}
+
+func (m *UpstreamMonitor) States() []UpstreamState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	states := make([]UpstreamState, 0, len(m.upstreams))
+	for _, upstream := range m.upstreams {
+		states = append(states, *m.states[upstream])
+	}
+	return states
+}
+
+func (m *UpstreamMonitor) report(upstream string, statusCode int, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	state, exist := m.states[upstream]
+	if !exist {
+		return
+	}
+	if err == nil && statusCode < http.StatusInternalServerError {
+		state.LastSuccess = time.Now()
+		state.Failures = 0
+		return
+	}
+	state.LastFailure = time.Now()
+	state.Failures += 1
+	if err != nil {
+		state.LastError = err.Error()
+	} else {
+		state.LastError = http.StatusText(statusCode)
+	}
+}
+
+type monitoredTransport struct {
+	transport http.RoundTripper
+	monitor   *UpstreamMonitor
+}
+
+func (t *monitoredTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	upstream := getUpstreamKey(request.URL)
+	setLogUpstream(request, upstream)
+
+	response, err := t.transport.RoundTrip(request)
+	statusCode := 0
+	if response != nil {
+		statusCode = response.StatusCode
+	}
+	t.monitor.report(upstream, statusCode, err)
+	return response, err
+}
+
+// HealthChecker serves /healthz (liveness) and /readyz (readiness) endpoints.
+// Leska is ready if storage directory is writable, its size does not exceed
+// quota, store loop is running and may accept requests and repeater is running.
+// Detailed state of checks, upstreams and queues is returned by '/readyz?verbose'.
+type HealthChecker struct {
+	config   HealthConfig
+	storage  string
+	storer   *storage.Storer
+	repeater *Repeater
+	monitor  *UpstreamMonitor
+}
+
+type HealthCheck struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+type QueueState struct {
+	Name     string `json:"name"`
+	Length   int    `json:"length"`
+	Capacity int    `json:"capacity"`
+}
+
+type ReadinessReport struct {
+	Ready     bool            `json:"ready"`
+	Checks    []HealthCheck   `json:"checks"`
+	Upstreams []UpstreamState `json:"upstreams"`
+	Queues    []QueueState    `json:"queues"`
+}
+
+func NewHealthChecker(config HealthConfig, storagePath string, storer *storage.Storer,
+	repeater *Repeater, monitor *UpstreamMonitor) *HealthChecker {
+
+	return &HealthChecker{
+		config:   config,
+		storage:  storagePath,
+		storer:   storer,
+		repeater: repeater,
+		monitor:  monitor,
+	}
+}
+
+// StartHealthServer starts server of health endpoints if its address is set.
+func StartHealthServer(logger *logging.Logger, checker *HealthChecker) error {
+	if checker.config.Address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", checker.config.Address)
+	if err != nil {
+		return errors.Wrapf(err, "cannot listen health address '%s'", checker.config.Address)
+	}
+	go func() {
+		if err := http.Serve(listener, checker); err != nil {
+			logger.Errorf("health server is stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (h *HealthChecker) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	switch request.URL.Path {
+	case "/healthz":
+		writeHealthResponse(response, http.StatusOK)
+	case "/readyz":
+		report := h.Check()
+		statusCode := http.StatusOK
+		if !report.Ready {
+			statusCode = http.StatusServiceUnavailable
+		}
+		if _, verbose := request.URL.Query()["verbose"]; !verbose {
+			writeHealthResponse(response, statusCode)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		response.WriteHeader(statusCode)
+		encoder := json.NewEncoder(response)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	default:
+		writeHealthResponse(response, http.StatusNotFound)
+	}
+}
+
+func (h *HealthChecker) Check() ReadinessReport {
+	state := h.storer.State()
+	report := ReadinessReport{
+		Ready: true,
+		Queues: []QueueState{
+			{Name: "storer", Length: state.Queued, Capacity: state.Capacity},
+			{Name: "chunks", Length: state.FinalizedChunks, Capacity: state.ChunksCapacity},
+		},
+		Upstreams: h.monitor.States(),
+	}
+	addCheck := func(name string, err error) {
+		check := HealthCheck{Name: name}
+		if err != nil {
+			check.Error = err.Error()
+			report.Ready = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	addCheck("storage", h.checkStorage())
+	addCheck("quota", h.checkQuota())
+	addCheck("storer", checkStorer(state))
+	addCheck("repeater", h.checkRepeater())
+	return report
+}
+
+func (h *HealthChecker) checkStorage() error {
+	file, err := ioutil.TempFile(h.storage, ".readyz")
+	if err != nil {
+		return errors.Wrap(err, "storage directory is not writable")
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func (h *HealthChecker) checkQuota() error {
+	if h.config.MaxStorageSize <= 0 {
+		return nil
+	}
+	size, err := storage.StorageSize(h.storage)
+	if err != nil {
+		return err
+	}
+	if size > h.config.MaxStorageSize {
+		return errors.Errorf("size of storage %d exceeds quota %d", size, h.config.MaxStorageSize)
+	}
+	return nil
+}
+
+func (h *HealthChecker) checkRepeater() error {
+	if !h.repeater.IsRunning() {
+		return errors.New("repeater is not running")
+	}
+	return nil
+}
+
+func checkStorer(state storage.StorerState) error {
+	if !state.Running {
+		return errors.New("store loop is not running")
+	}
+	if state.Queued >= state.Capacity {
+		return errors.Errorf("storer queue is full (%d)", state.Capacity)
+	}
+	return nil
+}
+
+// Helpers
+func writeHealthResponse(response http.ResponseWriter, statusCode int) {
+	response.WriteHeader(statusCode)
+	response.Write([]byte(http.StatusText(statusCode)))
+}
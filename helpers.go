@@ -1,27 +1,58 @@
 package main
 
 import (
+	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/lyobzik/leska/storage"
+	"github.com/lyobzik/leska/tracing"
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
 	"github.com/vulcand/oxy/forward"
-	"github.com/vulcand/oxy/roundrobin"
 )
 
-func CreateLogger(level logging.Level, prefix string) (*logging.Logger, error) {
+type EncryptionConfig struct {
+	KeyFile string `long:"key-file" description:"path to file with keys ('<id>:<base64 key>' per line) to encrypt stored requests"`
+	KeyEnv  string `long:"key-env" description:"name of environment variable with keys ('<id>:<base64 key>' separated by commas) to encrypt stored requests"`
+	KeyID   uint16 `long:"key-id" description:"id of key to encrypt new requests (default: maximum id)"`
+}
+
+type CompressionConfig struct {
+	Codec   string `long:"codec" default:"none" choice:"none" choice:"gzip" choice:"snappy" description:"compression of stored requests"`
+	MinSize int    `long:"min-size" default:"1024" description:"minimum size of stored request to compress it"`
+}
+
+type TracingConfig struct {
+	Endpoint    string        `long:"endpoint" description:"URL of OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces (tracing is disabled by default)"`
+	ServiceName string        `long:"service-name" default:"leska" description:"service name of exported spans"`
+	Timeout     time.Duration `long:"timeout" default:"10s" description:"timeout of export request"`
+	BatchSize   int           `long:"batch-size" default:"512" description:"maximum number of spans in export request"`
+	Interval    time.Duration `long:"interval" default:"5s" description:"maximum delay of span export"`
+}
+
+func CreateLogger(level logging.Level, prefix string, format string) (*logging.Logger, error) {
 	logger, err := logging.GetLogger(prefix)
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot create logger")
 	}
 
-	backend := logging.NewLogBackend(os.Stderr, prefix, 0)
-
-	format := " %{color}%{time:15:04:05.000} [%{level}]%{color:reset} %{message}"
-	formatter := logging.MustStringFormatter(format)
-	formattedBackend := logging.NewBackendFormatter(backend, formatter)
+	var formattedBackend logging.Backend
+	switch format {
+	case JSONLogFormat:
+		// Prefix is not written, so each line is valid JSON object.
+		backend := logging.NewLogBackend(os.Stderr, "", 0)
+		formattedBackend = logging.NewBackendFormatter(backend, jsonFormatter{})
+	case TextLogFormat:
+		backend := logging.NewLogBackend(os.Stderr, prefix, 0)
+		format := " %{color}%{time:15:04:05.000} [%{level}]%{color:reset} %{message}"
+		formatter := logging.MustStringFormatter(format)
+		formattedBackend = logging.NewBackendFormatter(backend, formatter)
+	default:
+		return nil, errors.Errorf("unknown log format '%s'", format)
+	}
 
 	leveledBackend := logging.AddModuleLevel(formattedBackend)
 	leveledBackend.SetLevel(level, "")
@@ -30,23 +61,63 @@ func CreateLogger(level logging.Level, prefix string) (*logging.Logger, error) {
 	return logger, nil
 }
 
-func CreateForwarder(logger *logging.Logger, upstreams []string) (http.Handler, error) {
-	forwarder, err := forward.New(forward.Logger(logger))
+func CreateForwarder(logger *logging.Logger, upstreams []*Upstream, balancer string,
+	hashKey string, balancerRoutes []string, transport http.RoundTripper) (http.Handler, error) {
+
+	forwarder, err := forward.New(forward.Logger(logger), forward.RoundTripper(transport))
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot create forwarder")
 	}
+	return CreateRoutedBalancer(forwarder, balancer, hashKey, balancerRoutes, upstreams)
+}
 
-	loadBalancer, err := roundrobin.New(forwarder)
+// CreateCodec creates codec of stored requests. Keys from file and environment
+// variable are merged, so new key can be added without removing of old one.
+func CreateCodec(config EncryptionConfig, compressionConfig CompressionConfig) (*storage.Codec, error) {
+	compression, err := storage.ParseCompression(compressionConfig.Codec)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := createKeyring(config)
 	if err != nil {
-		return nil, errors.Wrapf(err, "cannot create load balancer")
+		return nil, err
 	}
+	return storage.NewCodec(keyring, compression, compressionConfig.MinSize), nil
+}
 
-	for _, upstream := range upstreams {
-		upstreamUrl, err := url.Parse(upstream)
+func createKeyring(config EncryptionConfig) (*storage.Keyring, error) {
+	keys := []string{}
+	if config.KeyFile != "" {
+		data, err := ioutil.ReadFile(config.KeyFile)
 		if err != nil {
-			return nil, errors.Wrapf(err, "cannot parse upstream address '%s'", upstream)
+			return nil, errors.Wrapf(err, "cannot read keys from '%s'", config.KeyFile)
+		}
+		keys = append(keys, string(data))
+	}
+	if config.KeyEnv != "" {
+		data, exist := os.LookupEnv(config.KeyEnv)
+		if !exist {
+			return nil, errors.Errorf("environment variable '%s' is not set", config.KeyEnv)
 		}
-		loadBalancer.UpsertServer(upstreamUrl)
+		keys = append(keys, data)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	keyring, err := storage.ParseKeyring(strings.Join(keys, "\n"), config.KeyID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse encryption keys")
+	}
+	return keyring, nil
+}
+
+// CreateTracer creates tracer which exports spans to OTLP collector, it returns
+// nil if tracing is disabled.
+func CreateTracer(logger *logging.Logger, config TracingConfig) *tracing.Tracer {
+	if config.Endpoint == "" {
+		return nil
 	}
-	return loadBalancer, nil
+	exporter := tracing.NewOTLPExporter(config.Endpoint, config.ServiceName, config.Timeout)
+	return tracing.StartTracer(logger, exporter, config.BatchSize, config.Interval)
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+	"github.com/op/go-logging"
+)
+
+const (
+	TextLogFormat = "text"
+	JSONLogFormat = "json"
+
+	RequestIDHeader = "X-Request-ID"
+)
+
+type requestLogKey struct{}
+
+// RequestLog is context of request which is written with log messages about it.
+// It is passed to logger as argument, so JSON formatter writes it as separate
+// fields and text formatter writes it as 'key=value' pairs.
+type RequestLog struct {
+	RequestID string
+	Upstream  string
+	Status    int
+	Attempt   int
+	Duration  time.Duration
+}
+
+func (l *RequestLog) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := []string{}
+	for _, field := range l.fields() {
+		parts = append(parts, fmt.Sprintf("%s=%v", field.name, field.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+type logField struct {
+	name  string
+	value interface{}
+}
+
+func (l *RequestLog) fields() []logField {
+	fields := []logField{{"request_id", l.RequestID}}
+	if l.Upstream != "" {
+		fields = append(fields, logField{"upstream", l.Upstream})
+	}
+	if l.Status != 0 {
+		fields = append(fields, logField{"status", l.Status})
+	}
+	if l.Attempt != 0 {
+		fields = append(fields, logField{"attempt", l.Attempt})
+	}
+	if l.Duration != 0 {
+		fields = append(fields, logField{"duration", l.Duration})
+	}
+	return fields
+}
+
+// EnsureRequestID sets X-Request-ID of request if client does not set it.
+func EnsureRequestID(request *http.Request) (string, error) {
+	if requestID := request.Header.Get(RequestIDHeader); requestID != "" {
+		return requestID, nil
+	}
+	requestID, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set(RequestIDHeader, requestID.String())
+	return requestID.String(), nil
+}
+
+// ServeRequest sends request to handler and fills log context of request by
+// upstream, status and duration of request.
+func ServeRequest(handler http.Handler, response *Response, request *Request,
+	requestLog *RequestLog) {
+
+	ctx := context.WithValue(request.httpRequest.Context(), requestLogKey{}, requestLog)
+	start := time.Now()
+	handler.ServeHTTP(response, request.httpRequest.WithContext(ctx))
+	requestLog.Duration = time.Since(start)
+	requestLog.Status = response.code
+}
+
+// setLogUpstream sets upstream to log context of request if it exists.
+func setLogUpstream(request *http.Request, upstream string) {
+	if requestLog, exist := request.Context().Value(requestLogKey{}).(*RequestLog); exist {
+		requestLog.Upstream = upstream
+	}
+}
+
+// Formatter of log records to JSON objects (one per line).
+type jsonFormatter struct{}
+
+func (f jsonFormatter) Format(calldepth int, record *logging.Record, writer io.Writer) error {
+	entry := map[string]interface{}{
+		"time":    record.Time.Format(time.RFC3339Nano),
+		"level":   record.Level.String(),
+		"module":  record.Module,
+		"message": record.Message(),
+	}
+	for _, arg := range record.Args {
+		if requestLog, converted := arg.(*RequestLog); converted && requestLog != nil {
+			for _, field := range requestLog.fields() {
+				if duration, converted := field.value.(time.Duration); converted {
+					entry[field.name+"_ms"] = duration.Seconds() * 1000
+				} else {
+					entry[field.name] = field.value
+				}
+			}
+		}
+	}
+	return json.NewEncoder(writer).Encode(entry)
+}
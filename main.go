@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"time"
@@ -8,18 +9,44 @@ import (
 	"github.com/facebookgo/httpdown"
 	"github.com/jessevdk/go-flags"
 	"github.com/lyobzik/go-utils"
+	"github.com/lyobzik/leska/middleware"
 	"github.com/lyobzik/leska/storage"
 	"github.com/op/go-logging"
 )
 
 type Config struct {
-	Upstreams     []string      `short:"u" long:"upstream" required:"true" description:"group of servers of final destination"`
-	Address       string        `short:"a" long:"address" required:"true" description:"listen address of this server"`
-	Storage       string        `short:"s" long:"storage" default:"storage" description:"path to directory to store failed requests"`
-	RepeatTimeout time.Duration `short:"t" long:"repeat-timeout" default:"0s" description:"timeout between repeated tries"`
-	RepeatNumber  int32         `short:"n" long:"repeat-number" default:"1" description:"maximum number of tries"`
-	Verbose       []bool        `short:"v" long:"verbose" description:"write detailed log"`
-	LogLevel      logging.Level `hidden:"true"`
+	Upstreams      []string          `short:"u" long:"upstream" required:"true" description:"group of servers of final destination (settings by query parameters: weight, tls-ca, tls-cert, tls-key, tls-server-name)"`
+	Balancer       string            `short:"b" long:"balancer" default:"roundrobin" choice:"roundrobin" choice:"leastconn" choice:"hash" description:"strategy of choosing upstream server"`
+	HashKey        string            `long:"hash-key" default:"path" description:"key of hash balancer: 'path', 'header:<name>' or 'cookie:<name>'"`
+	BalancerRoutes []string          `long:"balancer-route" description:"strategy of requests which path matches glob pattern (also for repeated requests), settings are set by query parameters: balancer, hash-key (e.g. '/users/*?balancer=hash&hash-key=header:X-User')"`
+	Address        string            `short:"a" long:"address" description:"listen address of this server (required if bulk replay is not used)"`
+	Storage        string            `short:"s" long:"storage" default:"storage" description:"path to directory to store failed requests"`
+	RepeatTimeout  time.Duration     `short:"t" long:"repeat-timeout" default:"0s" description:"timeout between repeated tries"`
+	RepeatNumber   int32             `short:"n" long:"repeat-number" default:"1" description:"maximum number of tries"`
+	RepeatWorkers  int               `long:"repeat-workers" default:"1" description:"number of concurrent repeated requests"`
+	ChunkLifetime  time.Duration     `long:"chunk-lifetime" default:"5s" description:"time to collect stored requests to chunk before it is passed to repeater (requests of queue mode wait for it before delivery)"`
+	Encryption     EncryptionConfig  `group:"Encryption of stored requests" namespace:"encryption"`
+	Compression    CompressionConfig `group:"Compression of stored requests" namespace:"compression"`
+	Redaction      RedactionConfig   `group:"Redaction of stored requests" namespace:"redaction"`
+	TLS            ListenerTLSConfig `group:"TLS of listener" namespace:"tls"`
+	Forward        TransportConfig   `group:"Forwarding of live requests" namespace:"forward"`
+	Replay         TransportConfig   `group:"Forwarding of repeated requests" namespace:"replay"`
+	Shutdown       ShutdownConfig    `group:"Shutdown" namespace:"shutdown"`
+	Health         HealthConfig      `group:"Health endpoints" namespace:"health"`
+	AccessLog      AccessLogConfig   `group:"Access log" namespace:"access-log"`
+	Tracing        TracingConfig     `group:"Tracing" namespace:"tracing"`
+	Callback       CallbackConfig    `group:"Completion callbacks" namespace:"callback"`
+	Ack            AckConfig         `group:"Acknowledgement of queued requests" namespace:"ack"`
+	Queue          QueueConfig       `group:"Filters of queued requests" namespace:"queue"`
+	Mutation       MutationConfig    `group:"Mutation of repeated requests" namespace:"mutation"`
+	Mirror         MirrorConfig      `group:"Mirroring of live requests" namespace:"mirror"`
+	Fanout         FanoutConfig      `group:"Fan-out delivery" namespace:"fanout"`
+	Middlewares    []string          `long:"middleware" description:"name of registered middleware which is added to chain of request handling (see plugins.go)"`
+	Status         StatusConfig      `group:"Status of queued requests" namespace:"status"`
+	BulkReplay     BulkReplayConfig  `group:"Bulk replay of storage directory" namespace:"bulk-replay"`
+	Verbose        []bool            `short:"v" long:"verbose" description:"write detailed log"`
+	LogFormat      string            `long:"log-format" default:"text" choice:"text" choice:"json" description:"format of log"`
+	LogLevel       logging.Level     `hidden:"true"`
 }
 
 func ParseArgs() Config {
@@ -32,6 +59,11 @@ func ParseArgs() Config {
 		}
 		os.Exit(1)
 	}
+	if config.Address == "" && config.BulkReplay.From == "" {
+		fmt.Fprintln(os.Stderr, "the required flag `-a, --address' was not specified")
+		parser.WriteHelp(os.Stderr)
+		os.Exit(1)
+	}
 	config.LogLevel = convertVerboseToLovLevel(config.Verbose)
 	return config
 }
@@ -64,32 +96,104 @@ func main() {
 
 	config := ParseArgs()
 
-	logger, err := CreateLogger(config.LogLevel, "leska")
+	logger, err := CreateLogger(config.LogLevel, "leska", config.LogFormat)
 	utils.HandleErrorWithoutLogger("cannot create logger", err)
 	logger.Debugf("start leska with config: %v", config)
 
 	// TODO: прокинуть Repeate-настроки куда нужно
-	forwarder, err := CreateForwarder(logger, config.Upstreams)
+	upstreams, err := ParseUpstreams(config.Upstreams)
+	utils.HandleError(logger, "cannot parse upstreams", err)
+
+	monitor := NewUpstreamMonitor(upstreams)
+	forwarder, err := CreateForwarder(logger, upstreams, config.Balancer, config.HashKey,
+		config.BalancerRoutes, monitor.Wrap(CreateTransport(config.Forward, upstreams)))
 	utils.HandleError(logger, "cannot create forwarder", err)
 
+	replayForwarder, err := CreateForwarder(logger, upstreams, config.Balancer, config.HashKey,
+		config.BalancerRoutes, NewHostTransport(monitor.Wrap(CreateTransport(config.Replay, upstreams))))
+	utils.HandleError(logger, "cannot create replay forwarder", err)
+
+	fanout, err := NewFanout(logger, config.Fanout, config.Forward, config.Replay)
+	utils.HandleError(logger, "cannot create fan-out", err)
+	// Stored requests of fan-out destinations are repeated to these destinations.
+	replayHandler := fanout.ReplayHandler(replayForwarder)
+
+	codec, err := CreateCodec(config.Encryption, config.Compression)
+	utils.HandleError(logger, "cannot create codec of stored requests", err)
+
+	redactor, err := NewRedactor(config.Redaction, codec.Keyring)
+	utils.HandleError(logger, "cannot create redactor", err)
+
+	accessLog, err := NewAccessLog(logger, config.AccessLog)
+	utils.HandleError(logger, "cannot create access log", err)
+	defer accessLog.Close()
+
+	tracer := CreateTracer(logger, config.Tracing)
+	defer tracer.Stop()
+
+	notifier, err := StartNotifier(logger, config.Callback)
+	utils.HandleError(logger, "cannot create notifier", err)
+	defer notifier.Stop()
+
+	mutator, err := NewMutator(config.Mutation)
+	utils.HandleError(logger, "cannot create mutator", err)
+
+	middlewares, err := middleware.NewChain(config.Middlewares)
+	utils.HandleError(logger, "cannot create middleware chain", err)
+
+	if config.BulkReplay.From != "" {
+		err = RunBulkReplay(logger, replayHandler, codec, redactor, accessLog, tracer,
+			notifier, mutator, middlewares, config.BulkReplay)
+		utils.HandleError(logger, "cannot replay storage", err)
+		return
+	}
+
+	tracker, err := OpenTracker(logger, config.Status, config.Storage, codec,
+		fanout.Names())
+	utils.HandleError(logger, "cannot open tracker", err)
+	defer tracker.Close()
+
 	storer, err := storage.StartStorer(logger, config.Storage, config.RepeatNumber,
-		5*time.Second, 100000)
+		config.ChunkLifetime, 100000, codec, tracker.StatusIndex())
 	utils.HandleError(logger, "cannot create storer", err)
-	defer storer.Stop()
 
-	repeater, err := StartRepeater(logger, forwarder, storer,
-		config.RepeatTimeout, config.RepeatNumber)
+	repeater, err := StartRepeater(logger, replayHandler, storer,
+		config.RepeatTimeout, config.RepeatNumber, config.RepeatWorkers, redactor, accessLog,
+		tracer, notifier, tracker, mutator, middlewares)
 	utils.HandleError(logger, "cannot create repeater", err)
-	defer repeater.Stop()
-
-	err = httpdown.ListenAndServe(
-		&http.Server{
-			Addr:    config.Address,
-			Handler: NewStreamer(logger, storer, forwarder),
-		},
-		&httpdown.HTTP{
-			StopTimeout: 10 * time.Second,
-			KillTimeout: 1 * time.Second,
-		})
+
+	mirrors, err := StartMirrors(logger, config.Mirror, config.Storage, config.RepeatNumber,
+		config.RepeatTimeout, config.ChunkLifetime, config.Forward, config.Replay, codec, redactor,
+		accessLog, tracer)
+	utils.HandleError(logger, "cannot start mirrors", err)
+
+	err = StartHealthServer(logger, NewHealthChecker(config.Health, config.Storage, storer,
+		repeater, monitor))
+	utils.HandleError(logger, "cannot start health server", err)
+
+	tlsConfig, err := CreateServerTLSConfig(logger, config.TLS)
+	utils.HandleError(logger, "cannot create TLS config", err)
+
+	acknowledger, err := NewAcknowledger(config.Ack)
+	utils.HandleError(logger, "cannot create acknowledger", err)
+
+	queueFilter, err := NewQueueFilter(config.Queue)
+	utils.HandleError(logger, "cannot create queue filter", err)
+
+	streamer := NewStreamer(logger, storer, forwarder, redactor, accessLog, tracer, notifier,
+		tracker, acknowledger, queueFilter, middlewares, mirrors, fanout)
+	server, err := httpdown.HTTP{
+		StopTimeout: config.Shutdown.StopTimeout,
+		KillTimeout: config.Shutdown.KillTimeout,
+	}.ListenAndServe(&http.Server{
+		Addr:      config.Address,
+		Handler:   streamer,
+		TLSConfig: tlsConfig,
+	})
 	utils.HandleError(logger, "cannot start server", err)
+
+	if err := WaitForShutdown(logger, server); err != nil {
+		logger.Errorf("server is stopped with error: %v", err)
+	}
+	Shutdown(logger, config.Shutdown, repeater, storer, mirrors)
 }
@@ -0,0 +1,197 @@
+// Package middleware allows to add custom stages to handling of requests without
+// changes of leska. Middleware is registered by Register in init function of its
+// package, the package is linked by blank import in plugins.go of leska and the
+// middleware is enabled by --middleware option.
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Context describes request on stage of handling. Middleware may change request
+// and response header.
+type Context struct {
+	Request   *http.Request
+	RequestID string
+	Attempt   int // 0 if it is unknown
+	// ReadBody returns whole request body, it is nil if body is not buffered yet.
+	ReadBody func() ([]byte, error)
+	// Response is set after response is received.
+	StatusCode     int
+	ResponseHeader http.Header
+}
+
+// Middleware must implement one or more hook interfaces below.
+type Middleware interface {
+	Name() string
+}
+
+// ReceiveHook is called when live request is received, request is rejected if
+// error is returned.
+type ReceiveHook interface {
+	OnReceive(context *Context) error
+}
+
+// BeforeForwardHook is called before live request is sent to upstream, request
+// is rejected if error is returned.
+type BeforeForwardHook interface {
+	BeforeForward(context *Context) error
+}
+
+// AfterResponseHook is called when upstream response of live request is received.
+type AfterResponseHook interface {
+	AfterResponse(context *Context)
+}
+
+// BeforeStoreHook is called before failed request is stored, request is not
+// stored if error is returned (client gets upstream error).
+type BeforeStoreHook interface {
+	BeforeStore(context *Context) error
+}
+
+// BeforeReplayHook is called before stored request is repeated, the attempt
+// fails if error is returned.
+type BeforeReplayHook interface {
+	BeforeReplay(context *Context) error
+}
+
+// AfterReplayHook is called when upstream response of repeated request is received.
+type AfterReplayHook interface {
+	AfterReplay(context *Context)
+}
+
+// RejectError is returned by hook to reject request with given status.
+type RejectError struct {
+	StatusCode int
+	Message    string
+}
+
+func Reject(statusCode int, message string) error {
+	return &RejectError{StatusCode: statusCode, Message: message}
+}
+
+func (e *RejectError) Error() string {
+	return e.Message
+}
+
+// StatusCode returns status of response to rejected request.
+func StatusCode(err error, defaultStatusCode int) int {
+	if rejectError, converted := errors.Cause(err).(*RejectError); converted {
+		return rejectError.StatusCode
+	}
+	return defaultStatusCode
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string]Middleware)
+)
+
+// Register makes middleware available by its name, it panics if name is
+// already registered.
+func Register(middleware Middleware) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, exist := registry[middleware.Name()]; exist {
+		panic("middleware '" + middleware.Name() + "' is already registered")
+	}
+	registry[middleware.Name()] = middleware
+}
+
+// Registered returns sorted names of registered middlewares.
+func Registered() []string {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Chain calls hooks of middlewares in order of chain. Hooks which return error
+// stop the chain.
+type Chain []Middleware
+
+// NewChain returns chain of registered middlewares with given names.
+func NewChain(names []string) (Chain, error) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	chain := make(Chain, 0, len(names))
+	for _, name := range names {
+		middleware, exist := registry[name]
+		if !exist {
+			return nil, errors.Errorf("middleware '%s' is not registered", name)
+		}
+		chain = append(chain, middleware)
+	}
+	return chain, nil
+}
+
+func (c Chain) OnReceive(context *Context) error {
+	for _, middleware := range c {
+		if hook, exist := middleware.(ReceiveHook); exist {
+			if err := hook.OnReceive(context); err != nil {
+				return errors.Wrapf(err, "middleware '%s' rejects request", middleware.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (c Chain) BeforeForward(context *Context) error {
+	for _, middleware := range c {
+		if hook, exist := middleware.(BeforeForwardHook); exist {
+			if err := hook.BeforeForward(context); err != nil {
+				return errors.Wrapf(err, "middleware '%s' rejects request", middleware.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (c Chain) AfterResponse(context *Context) {
+	for _, middleware := range c {
+		if hook, exist := middleware.(AfterResponseHook); exist {
+			hook.AfterResponse(context)
+		}
+	}
+}
+
+func (c Chain) BeforeStore(context *Context) error {
+	for _, middleware := range c {
+		if hook, exist := middleware.(BeforeStoreHook); exist {
+			if err := hook.BeforeStore(context); err != nil {
+				return errors.Wrapf(err, "middleware '%s' rejects storing of request", middleware.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (c Chain) BeforeReplay(context *Context) error {
+	for _, middleware := range c {
+		if hook, exist := middleware.(BeforeReplayHook); exist {
+			if err := hook.BeforeReplay(context); err != nil {
+				return errors.Wrapf(err, "middleware '%s' rejects replay of request", middleware.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (c Chain) AfterReplay(context *Context) {
+	for _, middleware := range c {
+		if hook, exist := middleware.(AfterReplayHook); exist {
+			hook.AfterReplay(context)
+		}
+	}
+}
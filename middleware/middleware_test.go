@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for middleware tests.
+type testMiddleware struct {
+	name   string
+	calls  *[]string
+	reject bool
+}
+
+func (m *testMiddleware) Name() string {
+	return m.name
+}
+
+func (m *testMiddleware) OnReceive(context *Context) error {
+	*m.calls = append(*m.calls, m.name+".receive")
+	context.Request.Header.Set("X-Tenant", m.name)
+	if m.reject {
+		return Reject(http.StatusForbidden, "forbidden")
+	}
+	return nil
+}
+
+func (m *testMiddleware) AfterReplay(context *Context) {
+	*m.calls = append(*m.calls, m.name+".replay")
+}
+
+type passiveMiddleware struct{}
+
+func (m passiveMiddleware) Name() string {
+	return "test-passive"
+}
+
+// Middleware tests.
+func TestChain(t *testing.T) {
+	calls := []string{}
+	Register(&testMiddleware{name: "test-first", calls: &calls})
+	Register(&testMiddleware{name: "test-second", calls: &calls, reject: true})
+	Register(passiveMiddleware{})
+	for _, name := range []string{"test-first", "test-passive", "test-second"} {
+		require.Contains(t, Registered(), name, "middleware must be registered")
+	}
+	require.Panics(t, func() { Register(passiveMiddleware{}) }, "middleware must not be registered twice")
+
+	_, err := NewChain([]string{"test-first", "unknown"})
+	require.Error(t, err, "chain with unknown middleware must not be created")
+
+	chain, err := NewChain([]string{"test-passive", "test-first", "test-second", "test-first"})
+	require.NoError(t, err, "cannot create chain")
+	context := &Context{Request: &http.Request{Header: make(http.Header)}}
+
+	err = chain.OnReceive(context)
+	require.Error(t, err, "request must be rejected")
+	require.Equal(t, http.StatusForbidden, StatusCode(err, http.StatusInternalServerError),
+		"incorrect status of rejected request")
+	require.Equal(t, []string{"test-first.receive", "test-second.receive"}, calls,
+		"chain must be stopped by error")
+	require.Equal(t, "test-second", context.Request.Header.Get("X-Tenant"), "request must be changed")
+
+	chain.AfterReplay(context)
+	require.Equal(t, "test-first.replay", calls[len(calls)-1], "incorrect order of hooks")
+	require.Len(t, calls, 5, "incorrect number of hooks")
+	require.NoError(t, chain.BeforeStore(context), "chain without hooks must not fail")
+	require.NoError(t, Chain(nil).BeforeReplay(context), "empty chain must not fail")
+}
+
+func TestStatusCode(t *testing.T) {
+	require.Equal(t, http.StatusTooManyRequests,
+		StatusCode(Reject(http.StatusTooManyRequests, "limit"), http.StatusBadGateway),
+		"incorrect status of reject error")
+	require.Equal(t, http.StatusBadGateway, StatusCode(nil, http.StatusBadGateway),
+		"incorrect default status")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyobzik/go-utils"
+	"github.com/lyobzik/leska/storage"
+	"github.com/lyobzik/leska/tracing"
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	mirrorsDirName = "mirrors"
+
+	storageParameter       = "storage"
+	repeatNumberParameter  = "repeat-number"
+	repeatTimeoutParameter = "repeat-timeout"
+)
+
+type MirrorConfig struct {
+	Targets   []string `long:"target" description:"URL of mirror which gets copy of each live request, settings are set by query parameters: storage (default '<storage>/mirrors/<host>-<hash of URL>'), repeat-number, repeat-timeout and settings of upstream"`
+	QueueSize int      `long:"queue-size" default:"1000" description:"maximum number of requests waiting to be sent to mirror, copy of request is dropped if queue is full"`
+	Workers   int      `long:"workers" default:"4" description:"number of concurrent requests to mirror (both live and repeated)"`
+}
+
+// MirrorTarget is mirror address with settings of its queue.
+type MirrorTarget struct {
+	Upstream      *Upstream
+	Storage       string
+	RepeatNumber  int32
+	RepeatTimeout time.Duration
+}
+
+// Mirror sends copies of live requests to secondary upstream. Copies are sent
+// in background, so mirror does not affect response to client. Failed copies are
+// stored to own storage of mirror and are repeated by own repeater.
+type Mirror struct {
+	logger   *logging.Logger
+	target   *MirrorTarget
+	handler  http.Handler
+	redactor *Redactor
+	storer   *storage.Storer
+	repeater *Repeater
+	requests chan *Request
+	stopper  *utils.Stopper
+}
+
+// Mirrors is set of mirrors, nil set is disabled.
+type Mirrors []*Mirror
+
+// ParseMirrorTarget parses mirror address, settings of mirror queue are removed
+// from address, the rest settings are parsed as settings of upstream.
+func ParseMirrorTarget(target string, storagePath string, repeatNumber int32,
+	repeatTimeout time.Duration) (*MirrorTarget, error) {
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse mirror address '%s'", target)
+	}
+	query := targetURL.Query()
+	result := &MirrorTarget{
+		Storage:       popParameter(query, storageParameter),
+		RepeatNumber:  repeatNumber,
+		RepeatTimeout: repeatTimeout,
+	}
+	if value := popParameter(query, repeatNumberParameter); value != "" {
+		number, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || number <= 0 {
+			return nil, errors.Errorf("incorrect repeat number of mirror '%s'", target)
+		}
+		result.RepeatNumber = int32(number)
+	}
+	if value := popParameter(query, repeatTimeoutParameter); value != "" {
+		if result.RepeatTimeout, err = time.ParseDuration(value); err != nil {
+			return nil, errors.Wrapf(err, "incorrect repeat timeout of mirror '%s'", target)
+		}
+	}
+	targetURL.RawQuery = query.Encode()
+	if result.Storage == "" {
+		// Mirrors may have the same host, so hash of the whole address is added.
+		host := strings.Replace(targetURL.Host, ":", "_", -1)
+		name := fmt.Sprintf("%s-%08x", host, crc32.ChecksumIEEE([]byte(targetURL.String())))
+		result.Storage = filepath.Join(storagePath, mirrorsDirName, name)
+	}
+
+	if result.Upstream, err = ParseUpstream(targetURL.String()); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func StartMirror(logger *logging.Logger, target *MirrorTarget, config MirrorConfig,
+	chunkLifetime time.Duration, forwardConfig TransportConfig, replayConfig TransportConfig,
+	codec *storage.Codec, redactor *Redactor, accessLog *AccessLog,
+	tracer *tracing.Tracer) (*Mirror, error) {
+
+	upstreams := []*Upstream{target.Upstream}
+	handler, err := CreateForwarder(logger, upstreams, RoundRobinStrategy, "", nil,
+		CreateTransport(forwardConfig, upstreams))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create mirror forwarder")
+	}
+	// Stored requests keep host of client request, it is replaced by host of mirror.
+	replayHandler, err := CreateForwarder(logger, upstreams, RoundRobinStrategy, "", nil,
+		NewHostTransport(CreateTransport(replayConfig, upstreams)))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create mirror replay forwarder")
+	}
+
+	success := false
+	storer, err := storage.StartStorer(logger, target.Storage, target.RepeatNumber,
+		chunkLifetime, 100000, codec, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create mirror storer")
+	}
+	defer func() {
+		if !success {
+			storer.Stop()
+		}
+	}()
+	// Mirror requests are not tracked and are not mutated, callbacks are sent only
+	// about requests to primary upstreams.
+	repeater, err := StartRepeater(logger, replayHandler, storer, target.RepeatTimeout,
+		target.RepeatNumber, config.Workers, redactor, accessLog, tracer, nil, nil, nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create mirror repeater")
+	}
+
+	mirror := &Mirror{
+		logger:   logger,
+		target:   target,
+		handler:  handler,
+		redactor: redactor,
+		storer:   storer,
+		repeater: repeater,
+		requests: make(chan *Request, config.QueueSize),
+		stopper:  utils.NewStopper(),
+	}
+	for i := 0; i < config.Workers || i == 0; i += 1 {
+		mirror.stopper.Add()
+		go mirror.sendLoop()
+	}
+	success = true
+	return mirror, nil
+}
+
+// Send queues copy of request, the copy is dropped if queue is full.
+func (m *Mirror) Send(request *Request) {
+	requestCopy, err := request.Clone()
+	if err != nil {
+		m.logger.Errorf("cannot copy request to mirror %v: %v", m.target.Upstream.URL, err)
+		return
+	}
+	select {
+	case m.requests <- requestCopy:
+	default:
+		requestCopy.Close()
+		m.logger.Errorf("request to mirror %v is dropped, queue is full", m.target.Upstream.URL)
+	}
+}
+
+// Stop stops sending of copies, queued copies are stored without sending, so
+// they are repeated after restart. Then repeater and storer of mirror are stopped.
+func (m *Mirror) Stop(repeaterTimeout time.Duration) {
+	m.stopper.Stop()
+	m.stopper.WaitDone()
+	for len(m.requests) > 0 {
+		m.storeRequest(<-m.requests)
+	}
+	if !m.repeater.StopWithTimeout(repeaterTimeout) {
+		m.logger.Errorf("repeater of mirror %v is not stopped in %v", m.target.Upstream.URL,
+			repeaterTimeout)
+	}
+	m.storer.Stop()
+}
+
+func (m *Mirror) sendLoop() {
+	defer m.stopper.Done()
+
+	for {
+		select {
+		case <-m.stopper.Stopping:
+			return
+		case request := <-m.requests:
+			m.sendRequest(request)
+		}
+	}
+}
+
+func (m *Mirror) sendRequest(request *Request) {
+	response, err := NewResponse()
+	if err != nil {
+		m.logger.Errorf("cannot create response of mirror %v: %v", m.target.Upstream.URL, err)
+		m.storeRequest(request)
+		return
+	}
+	defer response.Close()
+
+	requestLog := &RequestLog{
+		RequestID: request.httpRequest.Header.Get(RequestIDHeader),
+		Attempt:   1,
+	}
+	ServeRequest(m.handler, response, request, requestLog)
+	if !response.IsFailed() {
+		m.logger.Debugf("request is mirrored: %v", requestLog)
+		request.Close()
+		return
+	}
+	m.logger.Warningf("mirrored request is failed and stored to repeate: %v", requestLog)
+	m.storeRequest(request)
+}
+
+func (m *Mirror) storeRequest(request *Request) {
+	// Sensitive data must not be stored, so request is dropped if it cannot be redacted.
+	err := m.redactor.Redact(request)
+	if err == nil {
+		err = m.storer.Add(request)
+	}
+	if err != nil {
+		request.Close()
+		m.logger.Errorf("cannot store request to mirror %v: %v", m.target.Upstream.URL, err)
+	}
+}
+
+func StartMirrors(logger *logging.Logger, config MirrorConfig, storagePath string,
+	repeatNumber int32, repeatTimeout time.Duration, chunkLifetime time.Duration,
+	forwardConfig TransportConfig, replayConfig TransportConfig, codec *storage.Codec,
+	redactor *Redactor, accessLog *AccessLog, tracer *tracing.Tracer) (Mirrors, error) {
+
+	mirrors := make(Mirrors, 0, len(config.Targets))
+	storages := make(map[string]string)
+	for _, target := range config.Targets {
+		mirrorTarget, err := ParseMirrorTarget(target, storagePath, repeatNumber, repeatTimeout)
+		if err == nil {
+			err = checkMirrorStorage(target, mirrorTarget.Storage, storagePath, storages)
+		}
+		if err != nil {
+			mirrors.Stop(time.Second)
+			return nil, err
+		}
+		mirror, err := StartMirror(logger, mirrorTarget, config, chunkLifetime, forwardConfig,
+			replayConfig, codec, redactor, accessLog, tracer)
+		if err != nil {
+			mirrors.Stop(time.Second)
+			return nil, errors.Wrapf(err, "cannot start mirror '%s'", target)
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors, nil
+}
+
+// Send queues copies of request to all mirrors.
+func (m Mirrors) Send(request *Request) {
+	for _, mirror := range m {
+		mirror.Send(request)
+	}
+}
+
+// Stop stops mirrors in parallel, so shutdown takes repeater timeout at most
+// once.
+func (m Mirrors) Stop(repeaterTimeout time.Duration) {
+	var wait sync.WaitGroup
+	for _, mirror := range m {
+		wait.Add(1)
+		go func(mirror *Mirror) {
+			defer wait.Done()
+			mirror.Stop(repeaterTimeout)
+		}(mirror)
+	}
+	wait.Wait()
+}
+
+// Helpers
+// checkMirrorStorage checks that storage of mirror does not overlap primary
+// storage or storages of other mirrors (storer owns its directory), only
+// directory of mirrors inside primary storage is shared. Checked storage is
+// added to storages of mirrors.
+func checkMirrorStorage(target string, mirrorStorage string, storagePath string,
+	storages map[string]string) error {
+
+	storageDir, err := filepath.Abs(mirrorStorage)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get storage path of mirror '%s'", target)
+	}
+	primaryDir, err := filepath.Abs(storagePath)
+	if err != nil {
+		return errors.Wrap(err, "cannot get primary storage path")
+	}
+	mirrorsDir := filepath.Join(primaryDir, mirrorsDirName)
+	if isNestedPath(primaryDir, storageDir) || (isNestedPath(storageDir, primaryDir) &&
+		(storageDir == mirrorsDir || !isNestedPath(storageDir, mirrorsDir))) {
+
+		return errors.Errorf("storage '%s' of mirror '%s' overlaps primary storage '%s'",
+			storageDir, target, primaryDir)
+	}
+	for otherDir, other := range storages {
+		if isNestedPath(storageDir, otherDir) || isNestedPath(otherDir, storageDir) {
+			return errors.Errorf("mirrors '%s' and '%s' have overlapping storages '%s' and '%s'",
+				other, target, otherDir, storageDir)
+		}
+	}
+	storages[storageDir] = target
+	return nil
+}
+
+// isNestedPath returns true if path is equal to parent or is inside it, both
+// paths must be absolute.
+func isNestedPath(path string, parent string) bool {
+	relative, err := filepath.Rel(parent, path)
+	return err == nil && relative != ".." &&
+		!strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
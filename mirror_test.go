@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Mirror tests.
+func TestCheckMirrorStorage(t *testing.T) {
+	storages := map[string]string{}
+	for target, storage := range map[string]string{
+		"http://first":  "/storage/mirrors/first",
+		"http://second": "/mirrors/second",
+	} {
+		require.NoError(t, checkMirrorStorage(target, storage, "/storage", storages),
+			"storage '%s' of mirror must be allowed", storage)
+	}
+
+	for _, storage := range []string{"/storage", "/storage/", "/storage/mirrors", "/storage/chunks",
+		"/", "/storage/mirrors/first", "/storage/mirrors/first/nested", "/mirrors"} {
+
+		err := checkMirrorStorage("http://third", storage, "/storage", storages)
+		require.Error(t, err, "overlapping storage '%s' of mirror must not be allowed", storage)
+	}
+}
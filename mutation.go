@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReceivedHeader keeps time when request is received, it is stored with request
+// and is removed on replay.
+const ReceivedHeader = "X-Leska-Received"
+
+type MutationConfig struct {
+	SetHeaders    []string      `long:"set-header" description:"header which is set before replay ('<name>: <value template>', fields: .Attempt, .OriginalTime, .RequestID), e.g. 'X-Leska-Attempt: {{.Attempt}}'"`
+	RemoveHeaders []string      `long:"remove-header" description:"header which is removed before replay"`
+	Host          string        `long:"host" description:"Host header of replayed request"`
+	RewritePaths  []string      `long:"rewrite-path" description:"rewrite of path of replayed request ('<regexp>=<replacement>'), e.g. '^/v1/(.*)=/v2/$1'"`
+	TokenURL      string        `long:"token-url" description:"URL of local token endpoint which is requested before each replay, token is its body or 'access_token' field of its JSON body"`
+	TokenFile     string        `long:"token-file" description:"path to file with token which is read before each replay"`
+	TokenHeader   string        `long:"token-header" default:"Authorization" description:"header of token"`
+	TokenPrefix   string        `long:"token-prefix" default:"Bearer " description:"prefix of token in header"`
+	TokenTimeout  time.Duration `long:"token-timeout" default:"5s" description:"timeout of token request"`
+}
+
+// MutationData is data which is available in templates of headers.
+type MutationData struct {
+	Attempt      int
+	OriginalTime string // RFC3339, it is empty if time of request is unknown
+	RequestID    string
+}
+
+type headerMutation struct {
+	name  string
+	value *template.Template
+}
+
+type pathRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Mutator changes stored request before each replay, so expired tokens can be
+// refreshed and requests can be routed to new paths. Nil mutator is disabled.
+type Mutator struct {
+	setHeaders    []headerMutation
+	removeHeaders []string
+	host          string
+	rewritePaths  []pathRewrite
+	config        MutationConfig
+	client        *http.Client
+}
+
+func NewMutator(config MutationConfig) (*Mutator, error) {
+	if config.TokenURL != "" && config.TokenFile != "" {
+		return nil, errors.New("token URL and token file cannot be used together")
+	}
+	mutator := &Mutator{
+		removeHeaders: config.RemoveHeaders,
+		host:          config.Host,
+		config:        config,
+		client:        &http.Client{Timeout: config.TokenTimeout},
+	}
+	for _, header := range config.SetHeaders {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.Errorf("incorrect header '%s'", header)
+		}
+		value, err := template.New("header").Parse(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse template of header '%s'", header)
+		}
+		mutator.setHeaders = append(mutator.setHeaders,
+			headerMutation{name: strings.TrimSpace(parts[0]), value: value})
+	}
+	for _, rewrite := range config.RewritePaths {
+		position := strings.LastIndex(rewrite, "=")
+		if position < 0 {
+			return nil, errors.Errorf("incorrect rewrite of path '%s'", rewrite)
+		}
+		pattern, err := regexp.Compile(rewrite[:position])
+		if err != nil {
+			return nil, errors.Wrapf(err, "incorrect rewrite of path '%s'", rewrite)
+		}
+		mutator.rewritePaths = append(mutator.rewritePaths,
+			pathRewrite{pattern: pattern, replacement: rewrite[position+1:]})
+	}
+	return mutator, nil
+}
+
+// SetReceived saves time when request is received, it must be called before
+// request is stored.
+func SetReceived(request *Request, received time.Time) {
+	request.httpRequest.Header.Set(ReceivedHeader, received.UTC().Format(time.RFC3339Nano))
+}
+
+// Mutate changes request before replay. Error is returned if token cannot be
+// obtained, so request is not sent with expired token.
+func (m *Mutator) Mutate(request *Request, attempt int) error {
+	// Time of request is internal header, so it is removed even if mutator is disabled.
+	received := request.httpRequest.Header.Get(ReceivedHeader)
+	request.httpRequest.Header.Del(ReceivedHeader)
+	if m == nil {
+		return nil
+	}
+
+	header := request.httpRequest.Header
+	data := &MutationData{Attempt: attempt, RequestID: header.Get(RequestIDHeader)}
+	if receivedTime, err := time.Parse(time.RFC3339Nano, received); err == nil {
+		data.OriginalTime = receivedTime.Format(time.RFC3339)
+	}
+	for _, name := range m.removeHeaders {
+		header.Del(name)
+	}
+	for _, mutation := range m.setHeaders {
+		value := &bytes.Buffer{}
+		if err := mutation.value.Execute(value, data); err != nil {
+			return errors.Wrapf(err, "cannot execute template of header '%s'", mutation.name)
+		}
+		header.Set(mutation.name, value.String())
+	}
+
+	if len(m.rewritePaths) > 0 {
+		requestURL := request.httpRequest.URL
+		for _, rewrite := range m.rewritePaths {
+			requestURL.Path = rewrite.pattern.ReplaceAllString(requestURL.Path, rewrite.replacement)
+		}
+		requestURL.RawPath = ""
+		// Forwarder sends request URI, so it must be updated too.
+		request.httpRequest.RequestURI = requestURL.RequestURI()
+	}
+	if m.host != "" {
+		ctx := context.WithValue(request.httpRequest.Context(), hostKey{}, m.host)
+		request.httpRequest = *request.httpRequest.WithContext(ctx)
+	}
+
+	token, err := m.getToken()
+	if err != nil {
+		return errors.Wrap(err, "cannot get token")
+	}
+	if token != "" {
+		header.Set(m.config.TokenHeader, m.config.TokenPrefix+token)
+	}
+	return nil
+}
+
+func (m *Mutator) getToken() (string, error) {
+	if m.config.TokenFile != "" {
+		data, err := ioutil.ReadFile(m.config.TokenFile)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot read token file '%s'", m.config.TokenFile)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if m.config.TokenURL == "" {
+		return "", nil
+	}
+
+	response, err := m.client.Get(m.config.TokenURL)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot request token")
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot read token")
+	}
+	if response.StatusCode < 200 || 300 <= response.StatusCode {
+		return "", errors.Errorf("token endpoint returns %s", response.Status)
+	}
+	tokenResponse := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if json.Unmarshal(body, &tokenResponse) == nil && tokenResponse.AccessToken != "" {
+		return tokenResponse.AccessToken, nil
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Transport which replaces Host header of request by host which is set by mutator.
+// Forwarder sets Host header of upstream, so it is replaced after forwarder.
+type hostKey struct{}
+
+type hostTransport struct {
+	transport http.RoundTripper
+}
+
+func NewHostTransport(transport http.RoundTripper) http.RoundTripper {
+	return &hostTransport{transport: transport}
+}
+
+func (t *hostTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	host, exist := request.Context().Value(hostKey{}).(string)
+	if !exist {
+		return t.transport.RoundTrip(request)
+	}
+	hostRequest := *request
+	hostRequest.Host = host
+	return t.transport.RoundTrip(&hostRequest)
+}
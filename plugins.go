@@ -0,0 +1,9 @@
+package main
+
+// Middlewares are linked by blank imports of their packages, each package
+// registers its middlewares by middleware.Register in init function. Linked
+// middleware is enabled by --middleware option, e.g.:
+//
+//	import _ "example.com/leska-plugins/tenant"
+//
+//	leska --middleware tenant ...
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lyobzik/leska/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	VaultHeader = "X-Leska-Vault"
+
+	hashedValuePrefix = "sha256:"
+	maskedJSONValue   = `"***"`
+)
+
+type RedactionConfig struct {
+	DropHeaders  []string `long:"drop-header" description:"header which is removed from stored request"`
+	HashHeaders  []string `long:"hash-header" description:"header which value is replaced by its SHA-256 hash in stored request"`
+	VaultHeaders []string `long:"vault-header" description:"header which is stored encrypted and is restored on repeat (requires encryption keys)"`
+	MaskFields   []string `long:"mask-field" description:"path of field of JSON body which value is masked in stored request (e.g. 'user.password')"`
+}
+
+// Redactor removes sensitive data from request before it is stored.
+type Redactor struct {
+	dropHeaders  []string
+	hashHeaders  []string
+	vaultHeaders []string
+	maskFields   [][]string
+	keyring      *storage.Keyring
+}
+
+func NewRedactor(config RedactionConfig, keyring *storage.Keyring) (*Redactor, error) {
+	if len(config.VaultHeaders) > 0 && keyring == nil {
+		return nil, errors.New("vault headers require encryption keys")
+	}
+	redactor := &Redactor{
+		dropHeaders:  config.DropHeaders,
+		hashHeaders:  config.HashHeaders,
+		vaultHeaders: config.VaultHeaders,
+		keyring:      keyring,
+	}
+	for _, field := range config.MaskFields {
+		redactor.maskFields = append(redactor.maskFields, strings.Split(field, "."))
+	}
+	return redactor, nil
+}
+
+// Redact changes request before it is stored.
+func (r *Redactor) Redact(request *Request) error {
+	header := request.httpRequest.Header
+	// Client must not be able to inject vault values.
+	header.Del(VaultHeader)
+
+	if err := r.moveToVault(header); err != nil {
+		return errors.Wrap(err, "cannot move headers to vault")
+	}
+	for _, name := range r.dropHeaders {
+		header.Del(name)
+	}
+	for _, name := range r.hashHeaders {
+		values := header[http.CanonicalHeaderKey(name)]
+		for i, value := range values {
+			hash := sha256.Sum256([]byte(value))
+			values[i] = hashedValuePrefix + hex.EncodeToString(hash[:])
+		}
+	}
+	if err := r.maskBody(request); err != nil {
+		return errors.Wrap(err, "cannot mask body fields")
+	}
+	return nil
+}
+
+// Restore returns vault headers back to loaded request.
+func (r *Redactor) Restore(request *Request) error {
+	header := request.httpRequest.Header
+	vault := header.Get(VaultHeader)
+	if vault == "" {
+		return nil
+	}
+	header.Del(VaultHeader)
+	if r.keyring == nil {
+		return errors.New("request has vault headers, but encryption keys are not set")
+	}
+
+	parts := strings.SplitN(vault, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("incorrect format of vault")
+	}
+	keyID, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return errors.Wrap(err, "incorrect key id of vault")
+	}
+	sealedHeaders, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.Wrap(err, "cannot decode vault")
+	}
+	data, err := r.keyring.Open(uint16(keyID), sealedHeaders)
+	if err != nil {
+		return err
+	}
+	vaultHeaders := http.Header{}
+	if err := json.Unmarshal(data, &vaultHeaders); err != nil {
+		return errors.Wrap(err, "cannot parse vault")
+	}
+	for name, values := range vaultHeaders {
+		header[name] = values
+	}
+	return nil
+}
+
+func (r *Redactor) moveToVault(header http.Header) error {
+	vaultHeaders := http.Header{}
+	for _, name := range r.vaultHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if values, exist := header[name]; exist {
+			vaultHeaders[name] = values
+			header.Del(name)
+		}
+	}
+	if len(vaultHeaders) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(vaultHeaders)
+	if err != nil {
+		return err
+	}
+	keyID, sealedHeaders, err := r.keyring.Seal(data)
+	if err != nil {
+		return err
+	}
+	header.Set(VaultHeader, fmt.Sprintf("%d:%s", keyID,
+		base64.StdEncoding.EncodeToString(sealedHeaders)))
+	return nil
+}
+
+// maskBody replaces values of masked fields in place, the rest of body (numbers,
+// order of keys and formatting) is stored as it is sent by client.
+func (r *Redactor) maskBody(request *Request) error {
+	contentType := request.httpRequest.Header.Get("Content-Type")
+	if len(r.maskFields) == 0 || !strings.Contains(contentType, "json") {
+		return nil
+	}
+
+	body, err := request.ReadBody()
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	scanner := &maskScanner{decoder: json.NewDecoder(bytes.NewReader(body)), body: body,
+		fields: r.maskFields}
+	scanner.decoder.UseNumber()
+	if err := scanner.scanValue(nil); err != nil {
+		return errors.Wrap(err, "cannot parse JSON body")
+	}
+	if _, err := scanner.decoder.Token(); err != io.EOF {
+		return errors.New("cannot parse JSON body: data after top-level value")
+	}
+	if len(scanner.ranges) == 0 {
+		return nil
+	}
+
+	maskedBody := make([]byte, 0, len(body))
+	last := int64(0)
+	for _, valueRange := range scanner.ranges {
+		maskedBody = append(maskedBody, body[last:valueRange.start]...)
+		maskedBody = append(maskedBody, maskedJSONValue...)
+		last = valueRange.end
+	}
+	return request.SetBody(append(maskedBody, body[last:]...))
+}
+
+// Helpers
+// jsonRange is position of value in JSON document.
+type jsonRange struct {
+	start int64
+	end   int64
+}
+
+// maskScanner finds values of masked fields in JSON document. Path of field is
+// applied to each element of array.
+type maskScanner struct {
+	decoder *json.Decoder
+	body    []byte
+	fields  [][]string
+	ranges  []jsonRange
+}
+
+func (s *maskScanner) scanValue(path []string) error {
+	start := s.valueStart()
+	token, err := s.decoder.Token()
+	if err != nil {
+		return err
+	}
+	if s.isMasked(path) {
+		if err := s.skipValue(token); err != nil {
+			return err
+		}
+		s.ranges = append(s.ranges, jsonRange{start: start, end: s.decoder.InputOffset()})
+		return nil
+	}
+	switch token {
+	case json.Delim('{'):
+		for s.decoder.More() {
+			key, err := s.decoder.Token()
+			if err != nil {
+				return err
+			}
+			if err := s.scanValue(append(path[:len(path):len(path)], key.(string))); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for s.decoder.More() {
+			if err := s.scanValue(path); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	// Closing delimiter of object or array.
+	_, err = s.decoder.Token()
+	return err
+}
+
+// valueStart returns position of the next value, separators which precede it
+// are skipped.
+func (s *maskScanner) valueStart() int64 {
+	offset := s.decoder.InputOffset()
+	for offset < int64(len(s.body)) && strings.IndexByte(" \t\r\n:,", s.body[offset]) >= 0 {
+		offset += 1
+	}
+	return offset
+}
+
+func (s *maskScanner) skipValue(token json.Token) error {
+	depth := 0
+	for {
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth += 1
+		case json.Delim('}'), json.Delim(']'):
+			depth -= 1
+		}
+		if depth == 0 {
+			return nil
+		}
+		var err error
+		if token, err = s.decoder.Token(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *maskScanner) isMasked(path []string) bool {
+	for _, field := range s.fields {
+		if len(field) != len(path) {
+			continue
+		}
+		masked := true
+		for i := range field {
+			masked = masked && field[i] == path[i]
+		}
+		if masked {
+			return true
+		}
+	}
+	return false
+}
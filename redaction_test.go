@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for redaction tests.
+func redactTestBody(t *testing.T, config RedactionConfig, contentType string, body string) (string, error) {
+	redactor, err := NewRedactor(config, nil)
+	require.NoError(t, err, "cannot create redactor")
+
+	httpRequest := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	httpRequest.Header.Set("Content-Type", contentType)
+	request, err := NewRequest(httpRequest, 1024, unlimiedSize)
+	require.NoError(t, err, "cannot create request")
+	defer request.Close()
+
+	if err := redactor.Redact(request); err != nil {
+		return "", err
+	}
+	redacted, err := request.ReadBody()
+	require.NoError(t, err, "cannot read redacted body")
+	return string(redacted), nil
+}
+
+// Redaction tests.
+func TestRedactorMaskBody(t *testing.T) {
+	config := RedactionConfig{MaskFields: []string{"password", "card.number", "items.secret"}}
+
+	body, err := redactTestBody(t, config, "application/json",
+		`{"id": 12345678901234567891, "password" :"qwerty","card":{"number":[1, 2],"cvv":1.50},`+
+			"\n\t\"items\": [{\"secret\": {\"a\": [\"b\"]}, \"name\": \"x\"}, {\"name\": \"y\"}, 7]}")
+	require.NoError(t, err, "cannot redact body")
+	require.Equal(t, `{"id": 12345678901234567891, "password" :"***","card":{"number":"***","cvv":1.50},`+
+		"\n\t\"items\": [{\"secret\": \"***\", \"name\": \"x\"}, {\"name\": \"y\"}, 7]}", body,
+		"only masked values must be changed")
+
+	unchanged := `{ "id": 12345678901234567891, "user": {"password": "qwerty"} }`
+	body, err = redactTestBody(t, config, "application/json", unchanged)
+	require.NoError(t, err, "cannot redact body")
+	require.Equal(t, unchanged, body, "body without masked fields must not be changed")
+
+	body, err = redactTestBody(t, config, "text/plain", `{"password": "qwerty"}`)
+	require.NoError(t, err, "cannot redact body")
+	require.Equal(t, `{"password": "qwerty"}`, body, "body of not JSON request must not be changed")
+
+	for _, incorrectBody := range []string{`{"password": }`, `{"password": "qwerty"`, `{} {}`, `[1,]`} {
+		_, err := redactTestBody(t, config, "application/json", incorrectBody)
+		require.Error(t, err, "incorrect body '%s' must not be redacted", incorrectBody)
+	}
+}
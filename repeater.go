@@ -4,24 +4,45 @@ import (
 	"bufio"
 	"bytes"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/lyobzik/go-utils"
+	"github.com/lyobzik/leska/middleware"
 	"github.com/lyobzik/leska/storage"
+	"github.com/lyobzik/leska/tracing"
 	"github.com/op/go-logging"
+	"github.com/pkg/errors"
 )
 
+// AttemptsHeader keeps number of attempts which are made before request is
+// stored, it is stored with request and is not sent to upstream.
+const AttemptsHeader = "X-Leska-Attempts"
+
 type Repeater struct {
 	logger        *logging.Logger
 	handler       http.Handler
 	storer        *storage.Storer
 	repeatTimeout time.Duration
 	repeatNumber  int32
+	workers       int
+	redactor      *Redactor
+	accessLog     *AccessLog
+	tracer        *tracing.Tracer
+	notifier      *Notifier
+	tracker       *Tracker
+	mutator       *Mutator
+	middlewares   middleware.Chain
+	running       int32
+	done          chan struct{} // it is closed when repeate loop exits
 	stopper       *utils.Stopper
 }
 
 func NewRepeater(logger *logging.Logger, handler http.Handler, storer *storage.Storer,
-	repeatTimeout time.Duration, repeatNumber int32) (*Repeater, error) {
+	repeatTimeout time.Duration, repeatNumber int32, workers int, redactor *Redactor,
+	accessLog *AccessLog, tracer *tracing.Tracer, notifier *Notifier,
+	tracker *Tracker, mutator *Mutator, middlewares middleware.Chain) (*Repeater, error) {
 
 	return &Repeater{
 		logger:        logger,
@@ -29,14 +50,26 @@ func NewRepeater(logger *logging.Logger, handler http.Handler, storer *storage.S
 		storer:        storer,
 		repeatTimeout: repeatTimeout,
 		repeatNumber:  repeatNumber,
+		workers:       workers,
+		redactor:      redactor,
+		accessLog:     accessLog,
+		tracer:        tracer,
+		notifier:      notifier,
+		tracker:       tracker,
+		mutator:       mutator,
+		middlewares:   middlewares,
+		done:          make(chan struct{}),
 		stopper:       utils.NewStopper(),
 	}, nil
 }
 
 func StartRepeater(logger *logging.Logger, handler http.Handler, storer *storage.Storer,
-	repeatTimeout time.Duration, repeatNumber int32) (*Repeater, error) {
+	repeatTimeout time.Duration, repeatNumber int32, workers int, redactor *Redactor,
+	accessLog *AccessLog, tracer *tracing.Tracer, notifier *Notifier,
+	tracker *Tracker, mutator *Mutator, middlewares middleware.Chain) (*Repeater, error) {
 
-	repeater, err := NewRepeater(logger, handler, storer, repeatTimeout, repeatNumber)
+	repeater, err := NewRepeater(logger, handler, storer, repeatTimeout, repeatNumber, workers,
+		redactor, accessLog, tracer, notifier, tracker, mutator, middlewares)
 	if err == nil {
 		repeater.Start()
 	}
@@ -48,13 +81,35 @@ func (r *Repeater) Start() {
 	go r.repeateLoop()
 }
 
+// IsRunning returns true if repeate loop is running.
+func (r *Repeater) IsRunning() bool {
+	return atomic.LoadInt32(&r.running) != 0
+}
+
 func (r *Repeater) Stop() {
 	r.stopper.Stop()
 	r.stopper.WaitDone()
 }
 
+// StopWithTimeout stops started repeater and waits while it finishes current
+// request. Returns false if repeater is not stopped during timeout.
+func (r *Repeater) StopWithTimeout(timeout time.Duration) bool {
+	r.stopper.Stop()
+	select {
+	case <-r.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (r *Repeater) repeateLoop() {
-	defer r.stopper.Done()
+	atomic.StoreInt32(&r.running, 1)
+	defer func() {
+		atomic.StoreInt32(&r.running, 0)
+		close(r.done)
+		r.stopper.Done()
+	}()
 
 	for {
 		select {
@@ -72,51 +127,168 @@ func (r *Repeater) repeateLoop() {
 
 func (r *Repeater) repeateChunk(chunkName string) {
 	r.logger.Infof("repeate chunk %s", chunkName)
-	chunk, err := storage.OpenChunk(chunkName)
+	chunk, err := storage.OpenChunk(chunkName, r.storer.Codec())
 	if err != nil {
 		r.logger.Errorf("cannot load chunk from '%s': %v", chunkName, err)
 		return
 	}
 	defer chunk.Close()
 
-	chunk.ForEachActiveRecord(r.repeatTimeout, r.repeateRecord)
-	if chunk.Index.Header.ActiveCount > 0 {
+	completed := chunk.ForEachActiveRecordConcurrently(r.repeatTimeout, r.stopper.Stopping,
+		r.workers, r.repeateRecord)
+	// Save results of handled records, so not handled records are repeated after restart.
+	chunk.Flush()
+	if completed && chunk.Index.Header.ActiveCount > 0 {
 		// TODO: исправить и перенести в select выше, так как Chunks
 		// может иметь ограниченный размер.
-		r.storer.Chunks <- chunk.Path
+		select {
+		case r.storer.Chunks <- chunk.Path:
+		case <-r.stopper.Stopping:
+		}
 	}
 }
 
 func (r *Repeater) repeateRecord(chunk *storage.Chunk, record storage.IndexRecord) bool {
-	r.logger.Infof("repeate request from chunk: %v", chunk)
+	r.logger.Infof("repeate request from chunk '%s'", chunk.Path)
 	requestData, err := chunk.Restore(record)
 	if err != nil {
-		r.logger.Error("cannot restore record from chunk: %v", err)
+		r.logger.Errorf("cannot restore record from chunk '%s': %v", chunk.Path, err)
 		return false
 	}
 	requestDataReader := bufio.NewReader(bytes.NewBuffer(requestData))
 	request, err := LoadRequest(requestDataReader, 1024*1024)
 	if err != nil {
-		r.logger.Errorf("cannot load request: %v", err)
+		r.logger.Errorf("cannot load request from chunk '%s': %v", chunk.Path, err)
 		return false
 	}
 	defer request.Close()
 
-	return r.repeateRequest(request)
+	if err := r.redactor.Restore(request); err != nil {
+		r.logger.Errorf("cannot restore vault headers: %v", err)
+		return false
+	}
+	// Attempts which are made before storing are kept with request (request
+	// without them is stored after one attempt), TTL is decreased after each
+	// repeated attempt.
+	attempts := getAttempts(request.httpRequest.Header)
+	attempt := int(attempts+r.storer.AttemptsTTL(attempts)-record.TTL) + 1
+	return r.repeateRequest(request, attempt, record.TTL <= 1)
 }
 
-func (r *Repeater) repeateRequest(request *Request) bool {
+// repeateRequest sends request to upstream, attempt is used only to log it
+// (0 if it is unknown). Callback of request is notified if request is delivered
+// or if it is the last attempt.
+func (r *Repeater) repeateRequest(request *Request, attempt int, lastAttempt bool) bool {
 	response, err := NewResponse()
 	if err != nil {
 		return false
 	}
 	defer response.Close()
 
-	r.handler.ServeHTTP(response, &request.httpRequest)
+	// Number of attempts is internal header, so it is removed even if it is not used.
+	request.httpRequest.Header.Del(AttemptsHeader)
+	callbackURL, err := r.notifier.PopCallback(request.httpRequest.Header)
+	if err != nil {
+		r.logger.Errorf("cannot notify callback: %v", err)
+	}
+	trackingID := r.tracker.StartAttempt(request)
+
+	start := time.Now()
+	requestLog := &RequestLog{
+		RequestID: request.httpRequest.Header.Get(RequestIDHeader),
+		Attempt:   attempt,
+	}
+	// Request which cannot be prepared (e.g. token is not obtained or middleware
+	// rejects it) is not sent, the attempt is failed.
+	hookContext := &middleware.Context{
+		Request:   &request.httpRequest,
+		RequestID: requestLog.RequestID,
+		Attempt:   attempt,
+		ReadBody:  request.ReadBody,
+	}
+	prepareErr := r.mutator.Mutate(request, attempt)
+	if prepareErr == nil {
+		prepareErr = r.middlewares.BeforeReplay(hookContext)
+	}
+	span := r.startSpan(request)
+	if prepareErr != nil {
+		r.logger.Errorf("cannot prepare request: %v: %v", prepareErr, requestLog)
+		response.WriteHeader(http.StatusBadGateway)
+		requestLog.Status = response.code
+	} else {
+		ServeRequest(r.handler, response, request, requestLog)
+		hookContext.StatusCode, hookContext.ResponseHeader = response.code, response.Header()
+		r.middlewares.AfterReplay(hookContext)
+	}
+	r.accessLog.Log(NewAccessLogEntry(&request.httpRequest, start, requestLog, ReplayedAction, 0))
+	r.finishSpan(span, requestLog, response.IsFailed())
+
 	if response.IsFailed() {
-		r.logger.Errorf("cannot repeate request: %v", request)
+		r.logger.Errorf("cannot repeate request: %v", requestLog)
 	} else {
-		r.logger.Infof("repeate successfull: %v - %v", request, response)
+		r.logger.Infof("repeate successfull: %v", requestLog)
+	}
+	delivered := !response.IsFailed()
+	if !delivered && !lastAttempt {
+		r.tracker.FinishAttempt(trackingID, requestLog, response, nil, delivered, lastAttempt)
+		return delivered
+	}
+
+	body, err := r.readResponseBody(response, callbackURL)
+	if err != nil {
+		r.logger.Errorf("cannot read response body: %v: %v", err, requestLog)
+	}
+	r.tracker.FinishAttempt(trackingID, requestLog, response, body, delivered, lastAttempt)
+	r.notifier.Notify(callbackURL, requestLog, body, delivered)
+	return delivered
+}
+
+// readResponseBody reads body of final response once, it is stored and sent to
+// callback. Body is read only if it is used and only up to the largest size which
+// is used.
+func (r *Repeater) readResponseBody(response *Response, callbackURL string) ([]byte, error) {
+	maxSize, needed := r.tracker.ResponseBodySize()
+	if callbackURL != "" {
+		// Callback URL is returned only by enabled notifier.
+		if callbackSize := r.notifier.BodySize(); !needed || (maxSize > 0 && callbackSize > maxSize) {
+			maxSize = callbackSize
+		}
+		needed = true
+	}
+	if !needed {
+		return nil, nil
+	}
+	return response.ReadBody(maxSize)
+}
+
+// startSpan starts span of attempt. Traceparent stored with request refers to
+// span of the first attempt, so repeated attempt joins the original trace.
+func (r *Repeater) startSpan(request *Request) *tracing.Span {
+	header := request.httpRequest.Header
+	original, _ := tracing.ParseTraceparent(header.Get(tracing.TraceparentHeader))
+	span := r.tracer.Start("Repeater.attempt", tracing.ClientSpan, original)
+	if span != nil {
+		header.Set(tracing.TraceparentHeader, span.SpanContext().Traceparent())
+	}
+	return span
+}
+
+func (r *Repeater) finishSpan(span *tracing.Span, requestLog *RequestLog, failed bool) {
+	span.SetAttribute("leska.request_id", requestLog.RequestID)
+	span.SetAttribute("leska.upstream", requestLog.Upstream)
+	span.SetAttribute("leska.attempt", requestLog.Attempt)
+	span.SetAttribute("http.status_code", requestLog.Status)
+	if failed {
+		span.SetError(errors.Errorf("upstream returns %d", requestLog.Status))
+	}
+	span.Finish()
+}
+
+// Helpers
+func getAttempts(header http.Header) int32 {
+	attempts, err := strconv.ParseInt(header.Get(AttemptsHeader), 10, 32)
+	if err != nil || attempts < 0 {
+		return 1
 	}
-	return !response.IsFailed()
+	return int32(attempts)
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/lyobzik/leska/middleware"
+	"github.com/lyobzik/leska/storage"
+	"github.com/lyobzik/leska/tracing"
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	replaySkipped = iota
+	replaySucceeded
+	replayFailed
+)
+
+type BulkReplayConfig struct {
+	From        string  `long:"from" description:"path to storage directory to replay to upstreams, leska exits after replay"`
+	DryRun      bool    `long:"dry-run" description:"print requests which would be replayed without sending them"`
+	Commit      bool    `long:"commit" description:"update TTL of replayed records in source chunks (they are not changed by default)"`
+	Concurrency int     `long:"concurrency" default:"1" description:"number of concurrently replayed requests"`
+	Rate        float64 `long:"rate" default:"0" description:"maximum number of replayed requests per second (0 - unlimited)"`
+	Since       string  `long:"since" description:"skip records with last try before this time (RFC 3339)"`
+	Until       string  `long:"until" description:"skip records with last try after this time (RFC 3339)"`
+	Path        string  `long:"path" description:"glob pattern of path of replayed requests"`
+	Inactive    bool    `long:"inactive" description:"replay inactive records too"`
+}
+
+// BulkReplayer replays requests of finalized chunks of storage directory by the
+// same way as Repeater does.
+type BulkReplayer struct {
+	logger   *logging.Logger
+	repeater *Repeater
+	redactor *Redactor
+	codec    *storage.Codec
+	config   BulkReplayConfig
+	since    time.Time
+	until    time.Time
+	limiter  <-chan time.Time
+	mutex    sync.Mutex
+	counts   map[int]int
+}
+
+func NewBulkReplayer(logger *logging.Logger, handler http.Handler, codec *storage.Codec,
+	redactor *Redactor, accessLog *AccessLog, tracer *tracing.Tracer, notifier *Notifier,
+	mutator *Mutator, middlewares middleware.Chain, config BulkReplayConfig) (*BulkReplayer, error) {
+
+	repeater, err := NewRepeater(logger, handler, nil, 0, 0, 1, redactor, accessLog, tracer,
+		notifier, nil, mutator, middlewares)
+	if err != nil {
+		return nil, err
+	}
+	replayer := &BulkReplayer{
+		logger:   logger,
+		repeater: repeater,
+		redactor: redactor,
+		codec:    codec,
+		config:   config,
+		counts:   make(map[int]int),
+	}
+	if replayer.since, err = parseOptionalTime(config.Since); err != nil {
+		return nil, err
+	}
+	if replayer.until, err = parseOptionalTime(config.Until); err != nil {
+		return nil, err
+	}
+	if config.Concurrency <= 0 {
+		replayer.config.Concurrency = 1
+	}
+	return replayer, nil
+}
+
+func RunBulkReplay(logger *logging.Logger, handler http.Handler, codec *storage.Codec,
+	redactor *Redactor, accessLog *AccessLog, tracer *tracing.Tracer, notifier *Notifier,
+	mutator *Mutator, middlewares middleware.Chain, config BulkReplayConfig) error {
+
+	replayer, err := NewBulkReplayer(logger, handler, codec, redactor, accessLog, tracer,
+		notifier, mutator, middlewares, config)
+	if err != nil {
+		return err
+	}
+	return replayer.Run()
+}
+
+func (b *BulkReplayer) Run() error {
+	chunks, err := storage.ListChunks(b.config.From)
+	if err != nil {
+		return err
+	}
+	if b.config.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / b.config.Rate))
+		defer ticker.Stop()
+		b.limiter = ticker.C
+	}
+
+	for _, chunkPath := range chunks {
+		if err := b.replayChunk(chunkPath); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("replayed: %d, failed: %d, skipped: %d\n", b.counts[replaySucceeded],
+		b.counts[replayFailed], b.counts[replaySkipped])
+	return nil
+}
+
+func (b *BulkReplayer) replayChunk(chunkPath string) error {
+	openChunk := storage.OpenChunkReadOnly
+	if b.config.Commit && !b.config.DryRun {
+		openChunk = storage.OpenChunk
+	}
+	chunk, err := openChunk(chunkPath, b.codec)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open chunk '%s'", chunkPath)
+	}
+	defer chunk.Close()
+
+	results := make([]int, len(chunk.Index.Records))
+	records := make(chan int)
+	var wait sync.WaitGroup
+	for i := 0; i < b.config.Concurrency; i += 1 {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := range records {
+				results[i] = b.replayRecord(chunk, i)
+			}
+		}()
+	}
+	for i, record := range chunk.Index.Records {
+		if b.isMatchedRecord(record) {
+			records <- i
+		}
+	}
+	close(records)
+	wait.Wait()
+
+	now := time.Now()
+	for i, result := range results {
+		b.counts[result] += 1
+		if result != replaySkipped && b.config.Commit && !b.config.DryRun {
+			chunk.UpdateRecord(i, result == replaySucceeded, now)
+		}
+	}
+	chunk.Flush()
+	return nil
+}
+
+func (b *BulkReplayer) replayRecord(chunk *storage.Chunk, i int) int {
+	requestData, err := chunk.Restore(chunk.Index.Records[i])
+	if err != nil {
+		b.logger.Errorf("cannot restore record %d from chunk '%s': %v", i, chunk.Path, err)
+		return replayFailed
+	}
+	request, err := LoadRequest(bufio.NewReader(bytes.NewBuffer(requestData)), 1024*1024)
+	if err != nil {
+		b.logger.Errorf("cannot load request %d from chunk '%s': %v", i, chunk.Path, err)
+		return replayFailed
+	}
+	defer request.Close()
+
+	if b.config.Path != "" {
+		if matched, _ := path.Match(b.config.Path, request.httpRequest.URL.Path); !matched {
+			return replaySkipped
+		}
+	}
+	if b.config.DryRun {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		fmt.Printf("%s#%d: %s %s\n", chunk.Path, i, request.httpRequest.Method,
+			request.httpRequest.RequestURI)
+		return replaySkipped
+	}
+
+	if b.limiter != nil {
+		<-b.limiter
+	}
+	if err := b.redactor.Restore(request); err != nil {
+		b.logger.Errorf("cannot restore vault headers: %v", err)
+		return replayFailed
+	}
+	if b.repeater.repeateRequest(request, 0, false) {
+		return replaySucceeded
+	}
+	return replayFailed
+}
+
+func (b *BulkReplayer) isMatchedRecord(record storage.IndexRecord) bool {
+	if record.TTL <= 0 && !b.config.Inactive {
+		return false
+	}
+	lastTry := record.LastTryTime()
+	if !b.since.IsZero() && lastTry.Before(b.since) {
+		return false
+	}
+	return b.until.IsZero() || !lastTry.After(b.until)
+}
+
+// Helpers
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return result, errors.Wrapf(err, "incorrect time '%s'", value)
+	}
+	return result, nil
+}
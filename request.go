@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -61,6 +62,62 @@ func (r *Request) Save(file io.Writer) (int, error) {
 	return file.Write(buffer.Bytes())
 }
 
+// Clone returns independent copy of request, so it can be sent and stored
+// separately from original request.
+func (r *Request) Clone() (*Request, error) {
+	body, err := r.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := multibuf.New(bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot copy request body")
+	}
+	request := &Request{buffer: buffer}
+	// Copy is not bound to context of original request which is canceled when
+	// original request is handled.
+	copyRequest(&request.httpRequest, r.httpRequest.WithContext(context.Background()), buffer)
+	request.httpRequest.ContentLength = int64(len(body))
+	return request, nil
+}
+
+// Rewind resets position of body reader, so request can be sent again.
+func (r *Request) Rewind() error {
+	if _, err := r.buffer.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "cannot rewind request body")
+	}
+	return nil
+}
+
+// ReadBody returns whole request body. Position of body reader is reset, so body
+// can be read again.
+func (r *Request) ReadBody() ([]byte, error) {
+	if _, err := r.buffer.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "cannot rewind request body")
+	}
+	body, err := ioutil.ReadAll(r.buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read request body")
+	}
+	if _, err := r.buffer.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "cannot rewind request body")
+	}
+	return body, nil
+}
+
+// SetBody replaces request body.
+func (r *Request) SetBody(body []byte) error {
+	buffer, err := multibuf.New(bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "cannot copy request body")
+	}
+	r.buffer.Close()
+	r.buffer = buffer
+	r.httpRequest.Body = ioutil.NopCloser(buffer)
+	r.httpRequest.ContentLength = int64(len(body))
+	return nil
+}
+
 func (r *Request) copyRequest(req *http.Request) {
 	copyRequest(&r.httpRequest, req, r.buffer)
 }
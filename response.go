@@ -5,6 +5,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/vulcand/oxy/utils"
 	"io"
+	"io/ioutil"
 	"net/http"
 )
 
@@ -42,6 +43,26 @@ func (r *Response) Copy(response http.ResponseWriter) error {
 	return nil
 }
 
+// ReadBody returns response body which is limited by maximum size (0 - whole
+// body). Response cannot be copied after that.
+func (r *Response) ReadBody(maxSize int64) ([]byte, error) {
+	reader, err := r.buffer.Reader()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read response body")
+	}
+	defer reader.Close()
+
+	var bodyReader io.Reader = reader
+	if maxSize > 0 {
+		bodyReader = io.LimitReader(reader, maxSize)
+	}
+	body, err := ioutil.ReadAll(bodyReader)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read response body")
+	}
+	return body, nil
+}
+
 func (r *Response) IsFailed() bool {
 	return 500 <= r.code && r.code < 600
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/facebookgo/httpdown"
+	"github.com/lyobzik/leska/storage"
+	"github.com/op/go-logging"
+)
+
+type ShutdownConfig struct {
+	StopTimeout     time.Duration `long:"stop-timeout" default:"10s" description:"time to wait for in-flight requests"`
+	KillTimeout     time.Duration `long:"kill-timeout" default:"1s" description:"time to wait for closing of connections after stop timeout"`
+	RepeaterTimeout time.Duration `long:"repeater-timeout" default:"30s" description:"time to wait for repeater to finish current request"`
+}
+
+// WaitForShutdown waits for SIGTERM or SIGINT and stops server. Server stops
+// accepting new connections and waits for in-flight requests, so after return all
+// failed requests are passed to storer.
+func WaitForShutdown(logger *logging.Logger, server httpdown.Server) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Wait()
+	}()
+
+	select {
+	case receivedSignal := <-signals:
+		logger.Infof("receive signal %v, stop server", receivedSignal)
+		return server.Stop()
+	case err := <-serverDone:
+		return err
+	}
+}
+
+// Shutdown stops mirrors, repeater and storer. Repeater finishes current request
+// and saves state of chunk, storer stores all accepted requests to finalized chunk.
+func Shutdown(logger *logging.Logger, config ShutdownConfig, repeater *Repeater,
+	storer *storage.Storer, mirrors Mirrors) {
+
+	logger.Info("stop mirrors")
+	mirrors.Stop(config.RepeaterTimeout)
+
+	logger.Info("stop repeater")
+	if !repeater.StopWithTimeout(config.RepeaterTimeout) {
+		logger.Errorf("repeater is not stopped in %v", config.RepeaterTimeout)
+	}
+	logger.Info("stop storer")
+	storer.Stop()
+	logger.Info("leska is stopped")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lyobzik/leska/storage"
+	"github.com/nu7hatch/gouuid"
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	TrackingIDHeader = "X-Leska-Tracking-ID"
+
+	responseSuffix = "/response"
+)
+
+type StatusConfig struct {
+	Path            string        `long:"path" description:"path prefix of status endpoint of queued requests, e.g. '/_leska/status/' (empty - requests are not tracked)"`
+	Retention       time.Duration `long:"retention" default:"168h" description:"time to keep statuses of tracked requests"`
+	StoreResponses  bool          `long:"store-responses" description:"store final upstream responses of repeated requests, they are returned by '<path><tracking id>/response'"`
+	ResponseMaxAge  time.Duration `long:"response-max-age" default:"24h" description:"time to keep stored responses (0 - unlimited)"`
+	ResponseMaxSize int64         `long:"response-max-size" default:"0" description:"maximum total size of stored responses in bytes, the oldest responses are removed (0 - unlimited)"`
+}
+
+// TrackingStatus is response of status endpoint.
+type TrackingStatus struct {
+	TrackingID     string    `json:"tracking_id"`
+	Status         string    `json:"status"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	Updated        time.Time `json:"updated"`
+	Response       string    `json:"response,omitempty"` // path to stored response
+	// Statuses of fan-out destinations, request is delivered if all of them are delivered.
+	Destinations map[string]*TrackingStatus `json:"destinations,omitempty"`
+}
+
+// Tracker tracks queued requests. Queued request gets tracking id which is
+// stored with request, status of request and its final upstream response (if
+// it is enabled) are returned by status endpoint. Nil tracker is disabled.
+type Tracker struct {
+	logger          *logging.Logger
+	path            string
+	statuses        *storage.StatusIndex
+	responses       *storage.ResponseStore
+	responseMaxSize int64
+	destinations    []string // names of fan-out destinations
+}
+
+// OpenTracker opens index of statuses and store of responses in storage
+// directory, it returns nil if tracking is disabled. Status of request which is
+// delivered by fan-out consists of statuses of its destinations.
+func OpenTracker(logger *logging.Logger, config StatusConfig, storagePath string,
+	codec *storage.Codec, destinations []string) (*Tracker, error) {
+
+	if config.Path == "" {
+		return nil, nil
+	}
+	statuses, err := storage.OpenStatusIndex(storagePath, config.Retention)
+	if err != nil {
+		return nil, err
+	}
+	tracker := &Tracker{
+		logger:          logger,
+		path:            config.Path,
+		statuses:        statuses,
+		responseMaxSize: config.ResponseMaxSize,
+		destinations:    destinations,
+	}
+	if config.StoreResponses {
+		tracker.responses, err = storage.OpenResponseStore(storagePath, codec,
+			config.ResponseMaxAge, config.ResponseMaxSize)
+		if err != nil {
+			statuses.Close()
+			return nil, err
+		}
+	}
+	return tracker, nil
+}
+
+func (t *Tracker) Close() {
+	if t != nil {
+		t.statuses.Close()
+	}
+}
+
+// StatusIndex returns index of statuses, it must be passed to storer.
+func (t *Tracker) StatusIndex() *storage.StatusIndex {
+	if t == nil {
+		return nil
+	}
+	return t.statuses
+}
+
+// IsStatusRequest returns true if request must be handled by status endpoint.
+func (t *Tracker) IsStatusRequest(request *http.Request) bool {
+	return t != nil && strings.HasPrefix(request.URL.Path, t.path)
+}
+
+// Track sets tracking id of queued request.
+func (t *Tracker) Track(request *Request) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	trackingID, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create tracking id")
+	}
+	request.httpRequest.Header.Set(TrackingIDHeader, trackingID.String())
+	return trackingID.String(), nil
+}
+
+// ResponseBodySize returns size of final response body which is read to store
+// it (0 - whole body), it returns false if responses are not stored. It is one
+// byte larger than size of store, larger response is not stored since it can
+// never be kept.
+func (t *Tracker) ResponseBodySize() (int64, bool) {
+	if t == nil || t.responses == nil {
+		return 0, false
+	}
+	if t.responseMaxSize > 0 {
+		return t.responseMaxSize + 1, true
+	}
+	return 0, true
+}
+
+// Location returns path of status of request.
+func (t *Tracker) Location(trackingID string) string {
+	return t.path + trackingID
+}
+
+// SetQueued saves position of request which is stored before forwarding and is
+// queued after failure.
+func (t *Tracker) SetQueued(trackingID string, position storage.RecordPosition) error {
+	if t == nil || trackingID == "" {
+		return nil
+	}
+	return t.statuses.SetPosition(trackingID, position.Chunk, position.Record)
+}
+
+// SetDelivered saves status of request which is delivered without repeating,
+// it is used for fan-out destinations which accept request of failed fan-out.
+func (t *Tracker) SetDelivered(trackingID string, upstreamStatus int) error {
+	if t == nil || trackingID == "" {
+		return nil
+	}
+	return t.statuses.SetFinal(trackingID, storage.DeliveredStatus, upstreamStatus)
+}
+
+// SetDeadLettered saves status of request which is lost without repeating, it
+// is used for fan-out destinations which request cannot be stored to.
+func (t *Tracker) SetDeadLettered(trackingID string, upstreamStatus int) error {
+	if t == nil || trackingID == "" {
+		return nil
+	}
+	return t.statuses.SetFinal(trackingID, storage.DeadLetteredStatus, upstreamStatus)
+}
+
+// StartAttempt removes tracking id from repeated request (it is not sent to
+// upstream) and marks request as in progress.
+func (t *Tracker) StartAttempt(request *Request) string {
+	trackingID := request.httpRequest.Header.Get(TrackingIDHeader)
+	request.httpRequest.Header.Del(TrackingIDHeader)
+	if t != nil && trackingID != "" {
+		t.statuses.SetInProgress(trackingID, true)
+	}
+	return trackingID
+}
+
+// FinishAttempt updates status of request after repeated attempt. Final status
+// is saved if request is delivered or if it is the last attempt, final response
+// is stored if it is enabled.
+func (t *Tracker) FinishAttempt(trackingID string, requestLog *RequestLog, response *Response,
+	body []byte, delivered bool, lastAttempt bool) {
+
+	if t == nil || trackingID == "" {
+		return
+	}
+	t.statuses.SetInProgress(trackingID, false)
+	if !delivered && !lastAttempt {
+		return
+	}
+
+	status := storage.DeadLetteredStatus
+	if delivered {
+		status = storage.DeliveredStatus
+	}
+	if t.responses != nil && t.responseMaxSize > 0 && int64(len(body)) > t.responseMaxSize {
+		t.logger.Warningf("response is not stored, its body exceeds size of store: %v", requestLog)
+	} else if t.responses != nil {
+		storedResponse := &storage.StoredResponse{
+			StatusCode: response.code,
+			Header:     getStoredHeader(response.Header()),
+			Body:       body,
+		}
+		if err := t.responses.Save(trackingID, storedResponse); err != nil {
+			t.logger.Errorf("cannot store response: %v: %v", err, requestLog)
+		}
+	}
+	if err := t.statuses.SetFinal(trackingID, status, requestLog.Status); err != nil {
+		t.logger.Errorf("cannot update status of request: %v: %v", err, requestLog)
+	}
+}
+
+// ServeHTTP returns status of queued request by '<path><tracking id>': queued,
+// in_progress, delivered (with upstream status) or dead_lettered. Stored final
+// response is returned by '<path><tracking id>/response'.
+func (t *Tracker) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writeStatusResponse(response, http.StatusMethodNotAllowed)
+		return
+	}
+	trackingID := strings.TrimPrefix(request.URL.Path, t.path)
+	if strings.HasSuffix(trackingID, responseSuffix) {
+		t.serveResponse(response, strings.TrimSuffix(trackingID, responseSuffix))
+		return
+	}
+
+	trackingStatus, exist := t.getStatus(trackingID)
+	if !exist {
+		trackingStatus, exist = t.getFanoutStatus(trackingID)
+	}
+	if !exist {
+		writeStatusResponse(response, http.StatusNotFound)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	json.NewEncoder(response).Encode(trackingStatus)
+}
+
+func (t *Tracker) getStatus(trackingID string) (*TrackingStatus, bool) {
+	status, exist := t.statuses.Get(trackingID)
+	if !exist {
+		return nil, false
+	}
+	trackingStatus := &TrackingStatus{
+		TrackingID:     status.ID,
+		Status:         status.Status,
+		UpstreamStatus: status.UpstreamStatus,
+		Updated:        status.Updated,
+	}
+	if t.responses != nil && (status.Status == storage.DeliveredStatus ||
+		status.Status == storage.DeadLetteredStatus) {
+		trackingStatus.Response = t.Location(trackingID) + responseSuffix
+	}
+	return trackingStatus, true
+}
+
+// getFanoutStatus returns status of request which is delivered by fan-out. It is
+// in progress or queued while any destination is not finished, it is dead-lettered
+// if any destination is dead-lettered.
+func (t *Tracker) getFanoutStatus(trackingID string) (*TrackingStatus, bool) {
+	trackingStatus := &TrackingStatus{
+		TrackingID:   trackingID,
+		Status:       storage.DeliveredStatus,
+		Destinations: make(map[string]*TrackingStatus),
+	}
+	priorities := map[string]int{
+		storage.DeliveredStatus:    0,
+		storage.DeadLetteredStatus: 1,
+		storage.QueuedStatus:       2,
+		storage.InProgressStatus:   3,
+	}
+	for _, destination := range t.destinations {
+		status, exist := t.getStatus(destinationTrackingID(trackingID, destination))
+		if !exist {
+			continue
+		}
+		trackingStatus.Destinations[destination] = status
+		if priorities[status.Status] > priorities[trackingStatus.Status] {
+			trackingStatus.Status = status.Status
+		}
+		if status.Updated.After(trackingStatus.Updated) {
+			trackingStatus.Updated = status.Updated
+		}
+	}
+	return trackingStatus, len(trackingStatus.Destinations) > 0
+}
+
+func (t *Tracker) serveResponse(response http.ResponseWriter, trackingID string) {
+	if t.responses == nil {
+		writeStatusResponse(response, http.StatusNotFound)
+		return
+	}
+	storedResponse, err := t.responses.Load(trackingID)
+	if err != nil {
+		t.logger.Errorf("cannot load response: %v", err)
+		writeStatusResponse(response, http.StatusInternalServerError)
+		return
+	}
+	if storedResponse == nil {
+		writeStatusResponse(response, http.StatusNotFound)
+		return
+	}
+	utils.CopyHeaders(response.Header(), storedResponse.Header)
+	response.Header().Set(TrackingIDHeader, trackingID)
+	response.WriteHeader(storedResponse.StatusCode)
+	response.Write(storedResponse.Body)
+}
+
+// Helpers
+// getStoredHeader returns copy of upstream header without headers of transfer,
+// they are set again when stored body is returned.
+func getStoredHeader(header http.Header) http.Header {
+	storedHeader := http.Header{}
+	utils.CopyHeaders(storedHeader, header)
+	storedHeader.Del("Content-Length")
+	storedHeader.Del("Transfer-Encoding")
+	return storedHeader
+}
+
+func writeStatusResponse(response http.ResponseWriter, statusCode int) {
+	response.WriteHeader(statusCode)
+	response.Write([]byte(http.StatusText(statusCode)))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyobzik/leska/storage"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for tracker tests.
+func openTestTracker(t *testing.T, storagePath string, responseMaxSize int64) *Tracker {
+	tracker, err := OpenTracker(logging.MustGetLogger("tracker-test"), StatusConfig{
+		Path:            "/status/",
+		Retention:       time.Hour,
+		StoreResponses:  true,
+		ResponseMaxSize: responseMaxSize,
+	}, storagePath, storage.NewCodec(nil, storage.NoCompression, 0), nil)
+	require.NoError(t, err, "cannot open tracker")
+	return tracker
+}
+
+func finishTestAttempt(t *testing.T, tracker *Tracker, trackingID string, body string) {
+	response := createTestUpstreamResponse(t, http.StatusOK, body)
+	defer response.Close()
+	response.Header().Set("Content-Length", "1")
+	response.Header().Set("Transfer-Encoding", "chunked")
+
+	maxSize, needed := tracker.ResponseBodySize()
+	require.True(t, needed, "response body must be read to store it")
+	responseBody, err := response.ReadBody(maxSize)
+	require.NoError(t, err, "cannot read response body")
+	tracker.FinishAttempt(trackingID, &RequestLog{Status: http.StatusOK}, response, responseBody, true, false)
+}
+
+func getTestResponse(tracker *Tracker, trackingID string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	tracker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+		tracker.Location(trackingID)+responseSuffix, nil))
+	return recorder
+}
+
+// Tracker tests.
+func TestTrackerStoredResponse(t *testing.T) {
+	storagePath, err := ioutil.TempDir("", "tracker-test")
+	require.NoError(t, err, "cannot create test storage")
+	defer os.RemoveAll(storagePath)
+	tracker := openTestTracker(t, storagePath, 1000)
+	defer tracker.Close()
+
+	stored := "c8c9d2a4-5a0e-4bd4-8d2e-3c5f4f6d7a10"
+	finishTestAttempt(t, tracker, stored, "stored body")
+	recorder := getTestResponse(tracker, stored)
+	require.Equal(t, http.StatusOK, recorder.Code, "stored response must be returned")
+	require.Equal(t, "stored body", recorder.Body.String(), "incorrect body of stored response")
+	require.Equal(t, "test", recorder.Header().Get("X-Upstream"), "upstream header must be stored")
+	require.Empty(t, recorder.Header().Get("Content-Length"), "upstream content length must not be stored")
+	require.Empty(t, recorder.Header().Get("Transfer-Encoding"), "upstream transfer encoding must not be stored")
+
+	oversized := "0f0e7b1c-2d6a-4c1e-9a57-8b3d2e1f4c60"
+	finishTestAttempt(t, tracker, oversized, strings.Repeat("x", 1001))
+	require.Equal(t, http.StatusNotFound, getTestResponse(tracker, oversized).Code,
+		"response which exceeds size of store must not be stored")
+	status, exist := tracker.getStatus(oversized)
+	require.True(t, exist, "status of request must be saved")
+	require.Equal(t, storage.DeliveredStatus, status.Status, "incorrect status of request")
+}
@@ -1,9 +1,14 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lyobzik/go-utils"
@@ -18,12 +23,15 @@ const (
 
 type Chunk struct {
 	Index     *Index
+	Codec     *Codec
+	Stats     StoreStats // stats of data stored to chunk since it is created or opened
 	indexFile *os.File
 	dataFile  *os.File
+	readOnly  bool
 	Path      string
 }
 
-func CreateChunk(storagePath string) (*Chunk, error) {
+func CreateChunk(storagePath string, codec *Codec) (*Chunk, error) {
 	var indexFile, dataFile *os.File
 	success := false
 	defer func() {
@@ -42,10 +50,21 @@ func CreateChunk(storagePath string) (*Chunk, error) {
 	index, err := CreateIndex(indexFile)
 
 	success = true
-	return &Chunk{Index: index, indexFile: indexFile, dataFile: dataFile, Path: path}, nil
+	return &Chunk{Index: index, Codec: codec, indexFile: indexFile, dataFile: dataFile,
+		Path: path}, nil
 }
 
-func OpenChunk(path string) (*Chunk, error) {
+func OpenChunk(path string, codec *Codec) (*Chunk, error) {
+	return openChunk(path, codec, false)
+}
+
+// OpenChunkReadOnly opens chunk for inspection. Such chunk must not be changed,
+// and it is not removed on close even if it has no active records.
+func OpenChunkReadOnly(path string, codec *Codec) (*Chunk, error) {
+	return openChunk(path, codec, true)
+}
+
+func openChunk(path string, codec *Codec, readOnly bool) (*Chunk, error) {
 	var indexFile, dataFile *os.File
 	success := false
 	defer func() {
@@ -53,17 +72,81 @@ func OpenChunk(path string) (*Chunk, error) {
 		utils.TryCloseOnFail(success, indexFile)
 	}()
 
+	openIndexFile, openIndex := OpenIndexFile, OpenIndex
+	if readOnly {
+		openIndexFile, openIndex = OpenIndexFileReadOnly, OpenIndexReadOnly
+	}
+
 	var err error
-	if indexFile, err = OpenIndexFile(GetIndexPath(path)); err != nil {
+	if indexFile, err = openIndexFile(GetIndexPath(path)); err != nil {
 		return nil, errors.Wrapf(err, "cannot open index file of chunk '%s'", path)
 	}
 	if dataFile, err = os.Open(GetDataPath(path)); err != nil {
 		return nil, errors.Wrapf(err, "cannot open data file of chunk '%s'", path)
 	}
-	index, err := OpenIndex(indexFile)
+	index, err := openIndex(indexFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open index of chunk '%s'", path)
+	}
 
 	success = true
-	return &Chunk{Index: index, indexFile: indexFile, dataFile: dataFile, Path: path}, nil
+	return &Chunk{Index: index, Codec: codec, indexFile: indexFile, dataFile: dataFile,
+		readOnly: readOnly, Path: path}, nil
+}
+
+// ListChunks returns paths of finalized chunks of storage ordered by creation time.
+func ListChunks(storagePath string) ([]string, error) {
+	indexPaths, err := filepath.Glob(filepath.Join(storagePath, "*"+indexSuffix))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot list chunks of storage '%s'", storagePath)
+	}
+	chunks := make([]string, 0, len(indexPaths))
+	for _, indexPath := range indexPaths {
+		chunks = append(chunks, strings.TrimSuffix(indexPath, indexSuffix))
+	}
+	// Names of chunks are creation time in nanoseconds.
+	sort.Slice(chunks, func(i, j int) bool {
+		return len(chunks[i]) < len(chunks[j]) ||
+			len(chunks[i]) == len(chunks[j]) && chunks[i] < chunks[j]
+	})
+	return chunks, nil
+}
+
+// RecoverChunks finalizes chunks which are left unfinalized by crash, so their
+// records are repeated. It returns paths of recovered chunks.
+func RecoverChunks(storagePath string) ([]string, error) {
+	pattern := filepath.Join(storagePath, "*"+GetTmpPath(indexSuffix))
+	indexPaths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot list chunks of storage '%s'", storagePath)
+	}
+	recovered := make([]string, 0, len(indexPaths))
+	for _, indexPath := range indexPaths {
+		chunk := &Chunk{Path: strings.TrimSuffix(indexPath, GetTmpPath(indexSuffix))}
+		if err := chunk.finalizeFile("data", GetDataPath(chunk.Path)); err != nil {
+			return recovered, err
+		}
+		if err := chunk.finalizeFile("index", GetIndexPath(chunk.Path)); err != nil {
+			return recovered, err
+		}
+		recovered = append(recovered, chunk.Path)
+	}
+	return recovered, nil
+}
+
+// StorageSize returns total size of files of storage directory.
+func StorageSize(storagePath string) (int64, error) {
+	files, err := ioutil.ReadDir(storagePath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot read storage directory '%s'", storagePath)
+	}
+	size := int64(0)
+	for _, file := range files {
+		if !file.IsDir() {
+			size += file.Size()
+		}
+	}
+	return size, nil
 }
 
 func (c *Chunk) Store(data DataRecord) error {
@@ -71,22 +154,45 @@ func (c *Chunk) Store(data DataRecord) error {
 	if err != nil {
 		return errors.Wrapf(err, "cannot get write positiion")
 	}
-	size, err := data.Data.Save(c.dataFile)
+	newRecord := IndexRecord{TTL: data.TTL, LastTry: data.LastTry, Offset: offset}
+	rawSize, size, err := c.save(data.Data, &newRecord)
 	if err != nil {
 		return errors.Wrap(err, "cannot store data to chunk")
 	}
+	newRecord.Size = int64(size)
+	c.Stats.Add(rawSize, size)
 
 	record, err := c.Index.AppendRecord()
 	if err != nil {
 		return errors.Wrapf(err, "cannot append record to index")
 	}
-	record.Offset = offset
-	record.Size = int64(size)
-	record.TTL = data.TTL
-	record.LastTry = data.LastTry
+	*record = newRecord
+	// Appended record is counted as active, but inactive record is never repeated.
+	if newRecord.TTL <= 0 {
+		c.Index.Header.ActiveCount -= 1
+	}
 	return nil
 }
 
+// save writes data to data file and returns size of raw data and written size.
+func (c *Chunk) save(data Data, record *IndexRecord) (int, int, error) {
+	if c.Codec == nil {
+		size, err := data.Save(c.dataFile)
+		return size, size, err
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	if _, err := data.Save(buffer); err != nil {
+		return 0, 0, err
+	}
+	encodedData, err := c.Codec.Encode(buffer.Bytes(), record)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := c.dataFile.Write(encodedData)
+	return buffer.Len(), size, err
+}
+
 func (c *Chunk) Restore(record IndexRecord) ([]byte, error) {
 	// TODO: кажется это лучше будет сделать с использованием mmapped-файлов.
 	buffer := make([]byte, record.Size)
@@ -94,7 +200,7 @@ func (c *Chunk) Restore(record IndexRecord) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot read data")
 	}
-	return buffer, nil
+	return c.Codec.Decode(record, buffer)
 }
 
 func (c *Chunk) Flush() {
@@ -104,7 +210,7 @@ func (c *Chunk) Flush() {
 }
 
 func (c *Chunk) Close() error {
-	deleteChunk := c.Index.Header.ActiveCount == 0
+	deleteChunk := c.Index.Header.ActiveCount == 0 && !c.readOnly
 	c.Index.Close()
 	c.dataFile.Close()
 	c.indexFile.Close()
@@ -140,9 +246,43 @@ func (c *Chunk) finalizeFile(fileType, path string) error {
 	return nil
 }
 
+type StoreStats struct {
+	Records    int64
+	RawSize    int64 // in bytes
+	StoredSize int64 // in bytes
+}
+
+func (s *StoreStats) Add(rawSize, storedSize int) {
+	s.Records += 1
+	s.RawSize += int64(rawSize)
+	s.StoredSize += int64(storedSize)
+}
+
+func (s *StoreStats) Merge(stats StoreStats) {
+	s.Records += stats.Records
+	s.RawSize += stats.RawSize
+	s.StoredSize += stats.StoredSize
+}
+
+// CompressionRatio returns ratio of raw data size to stored data size.
+func (s StoreStats) CompressionRatio() float64 {
+	if s.StoredSize == 0 {
+		return 1
+	}
+	return float64(s.RawSize) / float64(s.StoredSize)
+}
+
 type ChunkRecordHandler func(*Chunk, IndexRecord) bool
 
-func (c *Chunk) ForEachActiveRecord(repeatTimeout time.Duration, handler ChunkRecordHandler) {
+func (c *Chunk) ForEachActiveRecord(repeatTimeout time.Duration, handler ChunkRecordHandler) bool {
+	return c.ForEachActiveRecordUntil(repeatTimeout, nil, handler)
+}
+
+// ForEachActiveRecordUntil works as ForEachActiveRecord, but stops handling after
+// current record if stopping channel is closed. Returns false if handling is stopped.
+func (c *Chunk) ForEachActiveRecordUntil(repeatTimeout time.Duration, stopping <-chan struct{},
+	handler ChunkRecordHandler) bool {
+
 	// TODO: переделать, так как использование с callback-функцией не очень удобное
 	// к тому же наружу можно возвращать уже []byte, который возвращается сейчас методом Restore.
 	// А регистрацию обработки можно вынести в отдельный метод.
@@ -153,16 +293,86 @@ func (c *Chunk) ForEachActiveRecord(repeatTimeout time.Duration, handler ChunkRe
 			continue
 		}
 
-		if handler(c, record) {
-			c.Index.Records[i].TTL = 0
-		} else {
-			c.Index.Records[i].TTL -= 1
+		c.UpdateRecord(i, handler(c, record), now)
+
+		select {
+		case <-stopping:
+			return false
+		default:
+		}
+	}
+	return true
+}
+
+// ForEachActiveRecordConcurrently works as ForEachActiveRecordUntil, but handles
+// up to workers records at once. Records are updated under lock, handler gets
+// each record only once. It returns when all started handlers are finished.
+func (c *Chunk) ForEachActiveRecordConcurrently(repeatTimeout time.Duration,
+	stopping <-chan struct{}, workers int, handler ChunkRecordHandler) bool {
+
+	if workers <= 1 {
+		return c.ForEachActiveRecordUntil(repeatTimeout, stopping, handler)
+	}
+	now := time.Now()
+	timeLimit := now.Add(-repeatTimeout)
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	defer wait.Wait()
+	slots := make(chan struct{}, workers)
+	for i, record := range c.Index.Records {
+		if record.TTL <= 0 || timeLimit.Before(record.LastTry) {
+			continue
 		}
-		c.Index.Records[i].LastTry = now
-		if c.Index.Records[i].TTL == 0 {
-			c.Index.Header.ActiveCount -= 1
+		select {
+		case slots <- struct{}{}:
+		case <-stopping:
+			return false
+		}
+		wait.Add(1)
+		go func(i int, record IndexRecord) {
+			defer func() {
+				<-slots
+				wait.Done()
+			}()
+			success := handler(c, record)
+			mutex.Lock()
+			defer mutex.Unlock()
+			c.UpdateRecord(i, success, now)
+		}(i, record)
+
+		select {
+		case <-stopping:
+			return false
+		default:
 		}
 	}
+	return true
+}
+
+// UpdateRecord updates active record after try to handle it. Successfully handled
+// record becomes inactive, otherwise its TTL is decreased.
+func (c *Chunk) UpdateRecord(i int, success bool, lastTry time.Time) {
+	record := &c.Index.Records[i]
+	if record.TTL <= 0 {
+		return
+	}
+	if success {
+		record.TTL = 0
+	} else {
+		record.TTL -= 1
+	}
+	record.LastTry = lastTry
+	if record.TTL == 0 {
+		c.Index.Header.ActiveCount -= 1
+	}
+}
+
+// SetTTL sets TTL of active record, record stays active.
+func (c *Chunk) SetTTL(i int, ttl int32) {
+	record := &c.Index.Records[i]
+	if record.TTL > 0 && ttl > 0 {
+		record.TTL = ttl
+	}
 }
 
 func GetIndexPath(path string) string {
@@ -2,8 +2,13 @@ package storage
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -48,14 +53,14 @@ func checkChunkPartNotExist(t *testing.T, path string) {
 	require.False(t, exist, "empty chunk must be removed on finalize")
 }
 
-func createTestChunk(t *testing.T, storagePath string) *Chunk {
-	chunk, err := CreateChunk(storagePath)
+func createTestChunk(t *testing.T, storagePath string, codec *Codec) *Chunk {
+	chunk, err := CreateChunk(storagePath, codec)
 	require.NoError(t, err, "cannot create chunk")
 	return chunk
 }
 
-func openTestChunk(t *testing.T, chunkPath string) *Chunk {
-	chunk, err := OpenChunk(chunkPath)
+func openTestChunk(t *testing.T, chunkPath string, codec *Codec) *Chunk {
+	chunk, err := OpenChunk(chunkPath, codec)
 	require.NoError(t, err, "cannot open chunk")
 	return chunk
 }
@@ -79,7 +84,7 @@ func storeDataToTestChunk(t *testing.T, chunk *Chunk, data string, ttl int32, la
 // Chunk tests.
 func TestCreateEmptyChunk(t *testing.T) {
 	runChunkTest(t, func(storagePath string) string {
-		chunk := createTestChunk(t, storagePath)
+		chunk := createTestChunk(t, storagePath, nil)
 		finalizeTestChunk(t, chunk)
 
 		return chunk.Path
@@ -88,7 +93,7 @@ func TestCreateEmptyChunk(t *testing.T) {
 
 func TestCreateAndReadEmptyChunk(t *testing.T) {
 	runChunkTest(t, func(storagePath string) string {
-		chunk := createTestChunk(t, storagePath)
+		chunk := createTestChunk(t, storagePath, nil)
 		chunk.Index.Header.ActiveCount = 1 // Weird trick for test.
 		closeTestChunk(t, chunk)
 
@@ -98,7 +103,7 @@ func TestCreateAndReadEmptyChunk(t *testing.T) {
 		err = os.Rename(GetTmpPath(dataPath), dataPath)
 		require.NoError(t, err, "cannot rename chunk data file")
 
-		chunk = openTestChunk(t, chunk.Path)
+		chunk = openTestChunk(t, chunk.Path, nil)
 		chunk.Index.Header.ActiveCount = 0 // Weird trick for test.
 		closeTestChunk(t, chunk)
 
@@ -112,14 +117,14 @@ func TestChunkStoreAndRestore(t *testing.T) {
 	lastTry := time.Now()
 
 	runChunkTest(t, func(storagePath string) string {
-		chunk := createTestChunk(t, storagePath)
+		chunk := createTestChunk(t, storagePath, nil)
 		for _, value := range expectedValues {
 			storeDataToTestChunk(t, chunk, value, ttl, lastTry)
 		}
 		chunk.Flush()
 		finalizeTestChunk(t, chunk)
 
-		chunk = openTestChunk(t, chunk.Path)
+		chunk = openTestChunk(t, chunk.Path, nil)
 		i := 0
 		chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
 			require.Equal(t, record.TTL, ttl, "incorrect TTL value of IndexRecord")
@@ -140,14 +145,14 @@ func TestChunkStoreAndRestoreWithDiffentTTLAndHandleErrors(t *testing.T) {
 	expectedValues := []string{"test", "qwerty", "Есть только две добродетели: деятельность и ум."}
 
 	runChunkTest(t, func(storagePath string) string {
-		chunk := createTestChunk(t, storagePath)
+		chunk := createTestChunk(t, storagePath, nil)
 		for i, value := range expectedValues {
 			storeDataToTestChunk(t, chunk, value, int32(i)+1, time.Now())
 		}
 		chunk.Flush()
 		finalizeTestChunk(t, chunk)
 
-		chunk = openTestChunk(t, chunk.Path)
+		chunk = openTestChunk(t, chunk.Path, nil)
 		for i := 0; i < len(expectedValues)+1; i += 1 {
 			j := i
 			chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
@@ -164,3 +169,244 @@ func TestChunkStoreAndRestoreWithDiffentTTLAndHandleErrors(t *testing.T) {
 		return chunk.Path
 	})
 }
+
+func TestChunkStoreInactiveRecord(t *testing.T) {
+	runChunkTest(t, func(storagePath string) string {
+		chunk := createTestChunk(t, storagePath, nil)
+		storeDataToTestChunk(t, chunk, "active", 1, time.Now())
+		storeDataToTestChunk(t, chunk, "inactive", 0, time.Now())
+		require.EqualValues(t, 1, chunk.Index.Header.ActiveCount, "inactive record must not be counted")
+		require.Empty(t, chunk.Verify(), "chunk with inactive record must be verified without problems")
+
+		chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
+			return true
+		})
+		require.Zero(t, chunk.Index.Header.ActiveCount, "all records must be handled")
+		finalizeTestChunk(t, chunk)
+
+		return chunk.Path
+	})
+}
+
+func TestChunkStoreAndRestoreEncrypted(t *testing.T) {
+	expectedValues := []string{"test", "qwerty", "Есть только две добродетели: деятельность и ум."}
+	keyring, err := ParseKeyring(testKey1, NoKeyID)
+	require.NoError(t, err, "cannot parse keyring")
+	codec := NewCodec(keyring, NoCompression, 0)
+
+	runChunkTest(t, func(storagePath string) string {
+		chunk := createTestChunk(t, storagePath, codec)
+		for _, value := range expectedValues {
+			storeDataToTestChunk(t, chunk, value, 2, time.Now())
+		}
+		chunk.Flush()
+		finalizeTestChunk(t, chunk)
+
+		data, err := ioutil.ReadFile(GetDataPath(chunk.Path))
+		require.NoError(t, err, "cannot read data file of chunk")
+		for _, value := range expectedValues {
+			require.NotContains(t, string(data), value, "data file contains plain data")
+		}
+
+		chunk = openTestChunk(t, chunk.Path, nil)
+		chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
+			_, err := chunk.Restore(record)
+			require.Error(t, err, "encrypted value must not be restored without keyring")
+			return false
+		})
+		closeTestChunk(t, chunk)
+
+		chunk = openTestChunk(t, chunk.Path, codec)
+		i := 0
+		chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
+			require.EqualValues(t, 1, record.KeyID, "incorrect KeyID value of IndexRecord")
+			data, err := chunk.Restore(record)
+			require.NoError(t, err, "cannot restore value from chunk")
+			require.Equal(t, expectedValues[i], string(data), "restore incorrect value")
+			i += 1
+			return true
+		})
+		closeTestChunk(t, chunk)
+
+		return chunk.Path
+	})
+}
+
+func TestChunkStoreAndRestoreCompressed(t *testing.T) {
+	expectedValues := []string{"test", strings.Repeat("qwerty", 100), strings.Repeat("test", 1000)}
+	compressions := []Compression{GzipCompression, SnappyCompression}
+	keyring, err := ParseKeyring(testKey1, NoKeyID)
+	require.NoError(t, err, "cannot parse keyring")
+
+	for _, compression := range compressions {
+		for _, codec := range []*Codec{NewCodec(nil, compression, 10), NewCodec(keyring, compression, 10)} {
+			runChunkTest(t, func(storagePath string) string {
+				chunk := createTestChunk(t, storagePath, codec)
+				for _, value := range expectedValues {
+					storeDataToTestChunk(t, chunk, value, 1, time.Now())
+				}
+				require.EqualValues(t, len(expectedValues), chunk.Stats.Records, "incorrect stored records count")
+				require.True(t, chunk.Stats.CompressionRatio() > 1, "data is not compressed")
+				chunk.Flush()
+				finalizeTestChunk(t, chunk)
+
+				chunk = openTestChunk(t, chunk.Path, codec)
+				i := 0
+				chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
+					expectedCompression := compression
+					if len(expectedValues[i]) < codec.CompressionMinSize {
+						expectedCompression = NoCompression
+					}
+					require.Equal(t, expectedCompression, record.Compression, "incorrect Compression of IndexRecord")
+					data, err := chunk.Restore(record)
+					require.NoError(t, err, "cannot restore value from chunk")
+					require.Equal(t, expectedValues[i], string(data), "restore incorrect value")
+					i += 1
+					return true
+				})
+				closeTestChunk(t, chunk)
+
+				return chunk.Path
+			})
+		}
+	}
+}
+
+func TestListChunks(t *testing.T) {
+	runChunkTest(t, func(storagePath string) string {
+		chunks := []*Chunk{}
+		for i := 0; i < 3; i += 1 {
+			chunk := createTestChunk(t, storagePath, nil)
+			storeDataToTestChunk(t, chunk, "test", 1, time.Now())
+			chunks = append(chunks, chunk)
+		}
+		for _, chunk := range chunks[:2] {
+			finalizeTestChunk(t, chunk)
+		}
+
+		chunkPaths, err := ListChunks(storagePath)
+		require.NoError(t, err, "cannot list chunks")
+		require.Equal(t, []string{chunks[0].Path, chunks[1].Path}, chunkPaths,
+			"only finalized chunks must be listed in creation order")
+
+		closeTestChunk(t, chunks[2])
+		return chunks[2].Path
+	})
+}
+
+func TestVerifyChunk(t *testing.T) {
+	expectedValues := []string{"test", "qwerty", "Есть только две добродетели: деятельность и ум."}
+
+	runChunkTest(t, func(storagePath string) string {
+		chunk := createTestChunk(t, storagePath, nil)
+		for _, value := range expectedValues {
+			storeDataToTestChunk(t, chunk, value, 1, time.Now())
+		}
+		chunk.Flush()
+		finalizeTestChunk(t, chunk)
+
+		chunk, err := OpenChunkReadOnly(chunk.Path, nil)
+		require.NoError(t, err, "cannot open chunk in read-only mode")
+		require.Empty(t, chunk.Verify(), "correct chunk must be verified without problems")
+		closeTestChunk(t, chunk)
+
+		err = os.Truncate(GetDataPath(chunk.Path), 5)
+		require.NoError(t, err, "cannot truncate data file")
+		chunk, err = OpenChunkReadOnly(chunk.Path, nil)
+		require.NoError(t, err, "cannot open chunk in read-only mode")
+		require.Len(t, chunk.Verify(), len(expectedValues)-1, "incorrect problems count")
+		closeTestChunk(t, chunk)
+
+		chunk = openTestChunk(t, chunk.Path, nil)
+		chunk.Index.Header.ActiveCount = 0 // Weird trick for test.
+		closeTestChunk(t, chunk)
+
+		return chunk.Path
+	})
+}
+
+func TestChunkHandlingUntilStop(t *testing.T) {
+	expectedValues := []string{"test", "qwerty", "Есть только две добродетели: деятельность и ум."}
+
+	runChunkTest(t, func(storagePath string) string {
+		chunk := createTestChunk(t, storagePath, nil)
+		for _, value := range expectedValues {
+			storeDataToTestChunk(t, chunk, value, 1, time.Now())
+		}
+
+		stopping := make(chan struct{})
+		completed := chunk.ForEachActiveRecordUntil(0, stopping, func(chunk *Chunk, record IndexRecord) bool {
+			close(stopping)
+			return true
+		})
+		require.False(t, completed, "handling must be stopped")
+		require.EqualValues(t, len(expectedValues)-1, chunk.Index.Header.ActiveCount,
+			"only one record must be handled")
+
+		completed = chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
+			return true
+		})
+		require.True(t, completed, "handling must be completed")
+		require.Zero(t, chunk.Index.Header.ActiveCount, "all records must be handled")
+		finalizeTestChunk(t, chunk)
+
+		return chunk.Path
+	})
+}
+
+func TestChunkConcurrentHandling(t *testing.T) {
+	workers := 4
+
+	runChunkTest(t, func(storagePath string) string {
+		chunk := createTestChunk(t, storagePath, nil)
+		for i := 0; i < 20; i += 1 {
+			storeDataToTestChunk(t, chunk, strconv.Itoa(i), 2, time.Time{})
+		}
+
+		var running, maxRunning int32
+		var mutex sync.Mutex
+		handled := make(map[string]bool)
+		completed := chunk.ForEachActiveRecordConcurrently(0, nil, workers,
+			func(chunk *Chunk, record IndexRecord) bool {
+				current := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				data, err := chunk.Restore(record)
+				require.NoError(t, err, "cannot restore value from chunk")
+				value, err := strconv.Atoi(string(data))
+				require.NoError(t, err, "restore incorrect value")
+
+				mutex.Lock()
+				require.False(t, handled[string(data)], "record must be handled once")
+				handled[string(data)] = true
+				if current > maxRunning {
+					maxRunning = current
+				}
+				mutex.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				return value%2 == 0
+			})
+		require.True(t, completed, "handling must be completed")
+		require.Len(t, handled, 20, "all records must be handled")
+		require.True(t, 1 < maxRunning && maxRunning <= int32(workers), "incorrect number of concurrent handlers")
+		require.EqualValues(t, 10, chunk.Index.Header.ActiveCount, "failed records must stay active")
+		for i, record := range chunk.Index.Records {
+			require.EqualValues(t, i%2, record.TTL, "incorrect TTL of record %d", i)
+		}
+
+		stopping := make(chan struct{})
+		close(stopping)
+		completed = chunk.ForEachActiveRecordConcurrently(0, stopping, workers,
+			func(chunk *Chunk, record IndexRecord) bool {
+				return true
+			})
+		require.False(t, completed, "handling must be stopped")
+
+		chunk.ForEachActiveRecordConcurrently(0, nil, workers, func(chunk *Chunk, record IndexRecord) bool {
+			return true
+		})
+		require.Zero(t, chunk.Index.Header.ActiveCount, "all records must be handled")
+		finalizeTestChunk(t, chunk)
+
+		return chunk.Path
+	})
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Codec transforms data of records when they are stored to chunk and restored
+// from it. Data is compressed and then encrypted. Parameters of transformation
+// are saved in IndexRecord, so data stored with other settings (e.g. before key
+// rotation) can be restored too.
+type Codec struct {
+	Keyring            *Keyring
+	Compression        Compression
+	CompressionMinSize int
+}
+
+func NewCodec(keyring *Keyring, compression Compression, compressionMinSize int) *Codec {
+	return &Codec{
+		Keyring:            keyring,
+		Compression:        compression,
+		CompressionMinSize: compressionMinSize,
+	}
+}
+
+func (c *Codec) Encode(data []byte, record *IndexRecord) ([]byte, error) {
+	record.KeyID = NoKeyID
+	record.Compression = NoCompression
+	if c == nil {
+		return data, nil
+	}
+
+	if c.Compression != NoCompression && len(data) >= c.CompressionMinSize {
+		compressedData, err := c.Compression.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		// Keep data uncompressed if compression is useless.
+		if len(compressedData) < len(data) {
+			data = compressedData
+			record.Compression = c.Compression
+		}
+	}
+
+	if c.Keyring != nil {
+		keyID, encryptedData, err := c.Keyring.Seal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot encrypt data")
+		}
+		data = encryptedData
+		record.KeyID = keyID
+	}
+	return data, nil
+}
+
+func (c *Codec) Decode(record IndexRecord, data []byte) ([]byte, error) {
+	if record.KeyID != NoKeyID {
+		if c == nil || c.Keyring == nil {
+			return nil, errors.New("data is encrypted, but keyring is not set")
+		}
+		var err error
+		if data, err = c.Keyring.Open(record.KeyID, data); err != nil {
+			return nil, err
+		}
+	}
+	return record.Compression.Decompress(data)
+}
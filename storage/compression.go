@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	GzipCompression
+	SnappyCompression
+)
+
+var compressionNames = map[Compression]string{
+	NoCompression:     "none",
+	GzipCompression:   "gzip",
+	SnappyCompression: "snappy",
+}
+
+func ParseCompression(name string) (Compression, error) {
+	for compression, compressionName := range compressionNames {
+		if compressionName == name {
+			return compression, nil
+		}
+	}
+	return NoCompression, errors.Errorf("unknown compression '%s'", name)
+}
+
+func (c Compression) String() string {
+	if name, exist := compressionNames[c]; exist {
+		return name
+	}
+	return "unknown"
+}
+
+func (c Compression) Compress(data []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case GzipCompression:
+		buffer := bytes.NewBuffer([]byte{})
+		writer := gzip.NewWriter(buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, errors.Wrap(err, "cannot compress data by gzip")
+		}
+		if err := writer.Close(); err != nil {
+			return nil, errors.Wrap(err, "cannot compress data by gzip")
+		}
+		return buffer.Bytes(), nil
+	case SnappyCompression:
+		return snappy.Encode(nil, data), nil
+	}
+	return nil, errors.Errorf("unknown compression %d", c)
+}
+
+func (c Compression) Decompress(data []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case GzipCompression:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decompress data by gzip")
+		}
+		defer reader.Close()
+		result, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decompress data by gzip")
+		}
+		return result, nil
+	case SnappyCompression:
+		result, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decompress data by snappy")
+		}
+		return result, nil
+	}
+	return nil, errors.Errorf("unknown compression %d", c)
+}
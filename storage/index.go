@@ -23,10 +23,20 @@ type IndexHeader struct {
 }
 
 type IndexRecord struct {
-	TTL     int32
-	LastTry time.Time
-	Offset  int64 // in bytes
-	Size    int64 // in bytes
+	TTL int32
+	// KeyID and Compression are placed to alignment gap after TTL, so index format
+	// is not changed and records of old indexes have zero values of these fields.
+	KeyID       uint16      // id of key which is used to encrypt data
+	Compression Compression // compression of data
+	LastTry     time.Time
+	Offset      int64 // in bytes
+	Size        int64 // in bytes
+}
+
+// LastTryTime returns LastTry which is safe to use. Location of time.Time is kept
+// as pointer, so it is invalid if index is written by other process.
+func (r IndexRecord) LastTryTime() time.Time {
+	return time.Unix(0, r.LastTry.UnixNano())
 }
 
 type Index struct {
@@ -41,6 +51,10 @@ func OpenIndexFile(path string) (*os.File, error) {
 	return os.OpenFile(path, os.O_RDWR, 0666)
 }
 
+func OpenIndexFileReadOnly(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
 func CreateIndex(file *os.File) (*Index, error) {
 	err := file.Truncate((int64)(unsafe.Sizeof(IndexHeader{})))
 	if err != nil {
@@ -68,12 +82,25 @@ func CreateIndex(file *os.File) (*Index, error) {
 }
 
 func OpenIndex(file *os.File) (*Index, error) {
-	data, err := mmap.Map(file, mmap.RDWR, 0)
+	return openIndex(file, mmap.RDWR)
+}
+
+// OpenIndexReadOnly opens index which must not be changed.
+func OpenIndexReadOnly(file *os.File) (*Index, error) {
+	return openIndex(file, mmap.RDONLY)
+}
+
+func openIndex(file *os.File, mode int) (*Index, error) {
+	data, err := mmap.Map(file, mode, 0)
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot map file to memory")
 	}
 
 	index := &Index{data: data, file: file}
+	if len(data) < int(unsafe.Sizeof(IndexHeader{})) {
+		data.Unmap()
+		return nil, errors.New("index file is too small")
+	}
 	index.Header = (*IndexHeader)(unsafe.Pointer(&data[0]))
 	if index.Header.Magic != indexMagic {
 		return nil, errors.New("incorrect magic number of index file")
@@ -81,6 +108,12 @@ func OpenIndex(file *os.File) (*Index, error) {
 	if index.Header.Version != indexVersion {
 		return nil, errors.New("unsupperted version of index file")
 	}
+	expectedSize := int64(unsafe.Sizeof(IndexHeader{})) +
+		index.Header.Length*int64(unsafe.Sizeof(IndexRecord{}))
+	if int64(len(data)) < expectedSize {
+		data.Unmap()
+		return nil, errors.Errorf("index file is truncated (%d < %d)", len(data), expectedSize)
+	}
 
 	index.recordsInfo = (*reflect.SliceHeader)(unsafe.Pointer(&index.Records))
 	index.recordsInfo.Data = uintptr(unsafe.Pointer(&data[0])) + unsafe.Sizeof(IndexHeader{})
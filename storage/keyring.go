@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Id of key for not encrypted data.
+	NoKeyID = 0
+)
+
+// Keyring keeps AES-GCM keys to encrypt stored data. New data is encrypted by
+// current key, other keys are used only to decrypt data stored before rotation.
+type Keyring struct {
+	keys      map[uint16]cipher.AEAD
+	currentID uint16
+}
+
+// ParseKeyring parses keys from string with items '<id>:<base64 key>' separated
+// by commas or new lines. Empty lines and lines starting with '#' are skipped.
+// Key must have 16, 24 or 32 bytes length (AES-128, AES-192 or AES-256). If
+// currentID is NoKeyID then key with maximum id becomes current.
+func ParseKeyring(keys string, currentID uint16) (*Keyring, error) {
+	keyring := &Keyring{keys: make(map[uint16]cipher.AEAD)}
+	items := strings.FieldsFunc(keys, func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.HasPrefix(item, "#") {
+			continue
+		}
+		if err := keyring.addKey(item); err != nil {
+			return nil, err
+		}
+	}
+	if len(keyring.keys) == 0 {
+		return nil, errors.New("keyring has no keys")
+	}
+
+	if currentID != NoKeyID {
+		if _, exist := keyring.keys[currentID]; !exist {
+			return nil, errors.Errorf("keyring has no key with id %d", currentID)
+		}
+		keyring.currentID = currentID
+	}
+	return keyring, nil
+}
+
+func (k *Keyring) CurrentID() uint16 {
+	return k.currentID
+}
+
+// Seal encrypts data by current key. Result contains nonce and encrypted data.
+func (k *Keyring) Seal(data []byte) (uint16, []byte, error) {
+	aead := k.keys[k.currentID]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return NoKeyID, nil, errors.Wrap(err, "cannot generate nonce")
+	}
+	return k.currentID, aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// Open decrypts data which is sealed by key with keyID.
+func (k *Keyring) Open(keyID uint16, data []byte) ([]byte, error) {
+	aead, exist := k.keys[keyID]
+	if !exist {
+		return nil, errors.Errorf("unknown key id %d", keyID)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonceSize := aead.NonceSize()
+	result, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot decrypt data by key %d", keyID)
+	}
+	return result, nil
+}
+
+func (k *Keyring) addKey(item string) error {
+	parts := strings.SplitN(item, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("key must be in format '<id>:<base64 key>'")
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil || id == NoKeyID {
+		return errors.Errorf("incorrect key id '%s'", parts[0])
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return errors.Wrapf(err, "cannot decode key %d", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create cipher by key %d", id)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create AES-GCM by key %d", id)
+	}
+	if _, exist := k.keys[uint16(id)]; exist {
+		return errors.Errorf("duplicated key id %d", id)
+	}
+
+	k.keys[uint16(id)] = aead
+	if k.currentID < uint16(id) {
+		k.currentID = uint16(id)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testKey1 = "1:MDEyMzQ1Njc4OWFiY2RlZg=="                     // AES-128
+	testKey2 = "2:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" // AES-256
+)
+
+// Helpers for keyring tests.
+func parseTestKeyring(t *testing.T, keys string, currentID uint16) *Keyring {
+	keyring, err := ParseKeyring(keys, currentID)
+	require.NoError(t, err, "cannot parse keyring")
+	return keyring
+}
+
+// Keyring tests.
+func TestParseKeyring(t *testing.T) {
+	keyring := parseTestKeyring(t, testKey1+","+testKey2, NoKeyID)
+	require.EqualValues(t, 2, keyring.CurrentID(), "key with maximum id must be current")
+
+	keyring = parseTestKeyring(t, "# comment\n"+testKey1+"\n\n"+testKey2+"\n", 1)
+	require.EqualValues(t, 1, keyring.CurrentID(), "incorrect current key")
+}
+
+func TestParseIncorrectKeyring(t *testing.T) {
+	incorrectKeyrings := []string{"", "# comment", "1", "0:MDEyMzQ1Njc4OWFiY2RlZg==", "1:qwerty",
+		"1:MDEy", testKey1 + "," + testKey1}
+	for _, keys := range incorrectKeyrings {
+		_, err := ParseKeyring(keys, NoKeyID)
+		require.Error(t, err, "incorrect keyring '%s' must be parsed with error", keys)
+	}
+
+	_, err := ParseKeyring(testKey1, 2)
+	require.Error(t, err, "current key must be in keyring")
+}
+
+func TestKeyringSealAndOpen(t *testing.T) {
+	expectedValue := "Есть только две добродетели: деятельность и ум."
+	keyring := parseTestKeyring(t, testKey1, NoKeyID)
+
+	keyID, data, err := keyring.Seal([]byte(expectedValue))
+	require.NoError(t, err, "cannot seal data")
+	require.EqualValues(t, 1, keyID, "data must be sealed by current key")
+	require.NotContains(t, string(data), expectedValue, "sealed data contains plain data")
+
+	value, err := keyring.Open(keyID, data)
+	require.NoError(t, err, "cannot open sealed data")
+	require.Equal(t, expectedValue, string(value), "open incorrect value")
+
+	data[len(data)-1] ^= 0xff
+	_, err = keyring.Open(keyID, data)
+	require.Error(t, err, "corrupted data must be opened with error")
+}
+
+func TestKeyringRotation(t *testing.T) {
+	expectedValue := "test"
+	oldKeyring := parseTestKeyring(t, testKey1, NoKeyID)
+	keyID, data, err := oldKeyring.Seal([]byte(expectedValue))
+	require.NoError(t, err, "cannot seal data")
+
+	newKeyring := parseTestKeyring(t, testKey1+","+testKey2, NoKeyID)
+	value, err := newKeyring.Open(keyID, data)
+	require.NoError(t, err, "cannot open data sealed by old key")
+	require.Equal(t, expectedValue, string(value), "open incorrect value")
+
+	_, err = newKeyring.Open(newKeyring.CurrentID(), data)
+	require.Error(t, err, "data must not be opened by other key")
+}
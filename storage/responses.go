@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyobzik/go-utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	responsesDirName   = "responses"
+	responseHeaderSize = 3 // key id and compression of encoded response
+	cleanupPeriod      = time.Minute
+)
+
+var responseIDPattern = regexp.MustCompile("^[0-9a-zA-Z-]+$")
+
+// StoredResponse is upstream response of repeated request.
+type StoredResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	Stored     time.Time   `json:"stored"`
+}
+
+// ResponseStore keeps responses by tracking ids of requests in separate files.
+// Responses are encoded by the same codec as stored requests. Responses older than
+// maximum age are removed, the oldest responses are removed if total size of
+// responses exceeds maximum size.
+type ResponseStore struct {
+	path        string
+	codec       *Codec
+	maxAge      time.Duration
+	maxSize     int64
+	mutex       sync.Mutex
+	lastCleanup time.Time
+}
+
+func OpenResponseStore(storagePath string, codec *Codec, maxAge time.Duration,
+	maxSize int64) (*ResponseStore, error) {
+
+	store := &ResponseStore{
+		path:    filepath.Join(storagePath, responsesDirName),
+		codec:   codec,
+		maxAge:  maxAge,
+		maxSize: maxSize,
+	}
+	if err := utils.EnsureDir(store.path); err != nil {
+		return nil, errors.Wrap(err, "cannot create response store directory")
+	}
+	return store, store.Cleanup()
+}
+
+func (s *ResponseStore) Save(id string, response *StoredResponse) error {
+	path, err := s.getPath(id)
+	if err != nil {
+		return err
+	}
+	response.Stored = time.Now()
+	data, err := json.Marshal(response)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode response")
+	}
+	record := IndexRecord{}
+	if data, err = s.codec.Encode(data, &record); err != nil {
+		return err
+	}
+	header := make([]byte, responseHeaderSize, responseHeaderSize+len(data))
+	binary.LittleEndian.PutUint16(header, record.KeyID)
+	header[2] = byte(record.Compression)
+
+	// Response is written to temporary file, so it is never read partially.
+	if err := ioutil.WriteFile(path+tmpSuffix, append(header, data...), 0600); err != nil {
+		return errors.Wrapf(err, "cannot write response '%s'", id)
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		return errors.Wrapf(err, "cannot save response '%s'", id)
+	}
+	return s.cleanupIfNeeded()
+}
+
+// Load returns stored response, it returns nil if response does not exist.
+func (s *ResponseStore) Load(id string) (*StoredResponse, error) {
+	path, err := s.getPath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "cannot read response '%s'", id)
+	}
+	if len(data) < responseHeaderSize {
+		return nil, errors.Errorf("response '%s' is truncated", id)
+	}
+	record := IndexRecord{
+		KeyID:       binary.LittleEndian.Uint16(data),
+		Compression: Compression(data[2]),
+	}
+	if data, err = s.codec.Decode(record, data[responseHeaderSize:]); err != nil {
+		return nil, errors.Wrapf(err, "cannot decode response '%s'", id)
+	}
+	response := &StoredResponse{}
+	if err := json.Unmarshal(data, response); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse response '%s'", id)
+	}
+	return response, nil
+}
+
+// Cleanup removes responses which exceed retention limits.
+func (s *ResponseStore) Cleanup() error {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return errors.Wrap(err, "cannot read response store directory")
+	}
+	// The newest responses are kept.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	notBefore := time.Now().Add(-s.maxAge)
+	size := int64(0)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), tmpSuffix) {
+			continue
+		}
+		size += file.Size()
+		if (s.maxAge > 0 && file.ModTime().Before(notBefore)) || (s.maxSize > 0 && size > s.maxSize) {
+			if err := os.Remove(filepath.Join(s.path, file.Name())); err != nil {
+				return errors.Wrapf(err, "cannot remove response '%s'", file.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (s *ResponseStore) cleanupIfNeeded() error {
+	s.mutex.Lock()
+	if time.Since(s.lastCleanup) < cleanupPeriod {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.lastCleanup = time.Now()
+	s.mutex.Unlock()
+	return s.Cleanup()
+}
+
+func (s *ResponseStore) getPath(id string) (string, error) {
+	if !responseIDPattern.MatchString(id) {
+		return "", errors.Errorf("incorrect response id '%s'", id)
+	}
+	return filepath.Join(s.path, id), nil
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for response store tests.
+func openTestResponseStore(t *testing.T, storagePath string, codec *Codec, maxAge time.Duration,
+	maxSize int64) *ResponseStore {
+
+	store, err := OpenResponseStore(storagePath, codec, maxAge, maxSize)
+	require.NoError(t, err, "cannot open response store")
+	return store
+}
+
+func saveTestResponse(t *testing.T, store *ResponseStore, id string, body string) {
+	response := &StoredResponse{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       []byte(body),
+	}
+	require.NoError(t, store.Save(id, response), "cannot save response '%s'", id)
+}
+
+func requireResponseExist(t *testing.T, store *ResponseStore, id string, exist bool) {
+	response, err := store.Load(id)
+	require.NoError(t, err, "cannot load response '%s'", id)
+	require.Equal(t, exist, response != nil, "incorrect existence of response '%s'", id)
+}
+
+// Response store tests.
+func TestResponseStore(t *testing.T) {
+	keyring, err := ParseKeyring(testKey1, NoKeyID)
+	require.NoError(t, err, "cannot parse keyring")
+	codecs := []*Codec{NewCodec(nil, NoCompression, 0), NewCodec(keyring, GzipCompression, 10)}
+	for _, codec := range codecs {
+		runStorerTest(t, func(storagePath string) {
+			store := openTestResponseStore(t, storagePath, codec, time.Hour, 0)
+			saveTestResponse(t, store, "first", "response body")
+
+			response, err := store.Load("first")
+			require.NoError(t, err, "cannot load response")
+			require.NotNil(t, response, "response must exist")
+			require.Equal(t, http.StatusCreated, response.StatusCode, "incorrect status code")
+			require.Equal(t, "text/plain", response.Header.Get("Content-Type"), "incorrect header")
+			require.Equal(t, "response body", string(response.Body), "incorrect body")
+
+			// Response must be kept after reopening.
+			store = openTestResponseStore(t, storagePath, codec, time.Hour, 0)
+			requireResponseExist(t, store, "first", true)
+			requireResponseExist(t, store, "unknown", false)
+		})
+	}
+}
+
+func TestResponseStoreIncorrectID(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		store := openTestResponseStore(t, storagePath, NewCodec(nil, NoCompression, 0), 0, 0)
+		for _, id := range []string{"", "../status.log", "first/response"} {
+			require.Error(t, store.Save(id, &StoredResponse{}), "response with id '%s' must not be saved", id)
+			_, err := store.Load(id)
+			require.Error(t, err, "response with id '%s' must not be loaded", id)
+		}
+	})
+}
+
+func TestResponseStoreCleanup(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		codec := NewCodec(nil, NoCompression, 0)
+		store := openTestResponseStore(t, storagePath, codec, time.Hour, 0)
+		saveTestResponse(t, store, "old", "old body")
+		saveTestResponse(t, store, "first", "first body")
+		saveTestResponse(t, store, "second", "second body")
+
+		old := time.Now().Add(-2 * time.Hour)
+		oldPath := filepath.Join(storagePath, responsesDirName, "old")
+		require.NoError(t, os.Chtimes(oldPath, old, old), "cannot change time of response")
+		firstPath := filepath.Join(storagePath, responsesDirName, "first")
+		first := time.Now().Add(-time.Minute)
+		require.NoError(t, os.Chtimes(firstPath, first, first), "cannot change time of response")
+
+		// Old response is removed by age.
+		require.NoError(t, store.Cleanup(), "cannot cleanup responses")
+		requireResponseExist(t, store, "old", false)
+		requireResponseExist(t, store, "first", true)
+		requireResponseExist(t, store, "second", true)
+
+		// The oldest response is removed by size.
+		info, err := os.Stat(filepath.Join(storagePath, responsesDirName, "second"))
+		require.NoError(t, err, "cannot get size of response")
+		store = openTestResponseStore(t, storagePath, codec, time.Hour, info.Size()+1)
+		requireResponseExist(t, store, "first", false)
+		requireResponseExist(t, store, "second", true)
+	})
+}
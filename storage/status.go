@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lyobzik/go-utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	statusIndexName = "status.log"
+
+	QueuedStatus       = "queued"
+	InProgressStatus   = "in_progress"
+	DeliveredStatus    = "delivered"
+	DeadLetteredStatus = "dead_lettered"
+)
+
+// RequestStatus is status of stored request which is tracked by its tracking id.
+type RequestStatus struct {
+	ID             string    `json:"id"`
+	Status         string    `json:"status"`
+	Chunk          string    `json:"chunk,omitempty"`
+	Record         int       `json:"record"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	Updated        time.Time `json:"updated"`
+}
+
+// StatusIndex maps tracking ids of stored requests to chunk and record positions
+// and keeps final statuses of requests. Changes are appended to log file in
+// storage directory, so statuses are kept after restart. Log is compacted on
+// opening and periodically on updates, final statuses which are not updated
+// during retention period are removed (stored requests are tracked until they
+// are finished). In progress status is not persisted, request which is added to
+// storer is reported as queued until its position is saved. Nil status index is
+// disabled.
+type StatusIndex struct {
+	mutex       sync.Mutex
+	path        string
+	retention   time.Duration
+	file        *os.File
+	statuses    map[string]*RequestStatus
+	inProgress  map[string]bool
+	pending     map[string]time.Time // requests which are not written to chunk yet
+	lastCompact time.Time
+}
+
+func OpenStatusIndex(storagePath string, retention time.Duration) (*StatusIndex, error) {
+	if err := utils.EnsureDir(storagePath); err != nil {
+		return nil, errors.Wrap(err, "cannot create storage directory")
+	}
+	index := &StatusIndex{
+		path:       filepath.Join(storagePath, statusIndexName),
+		retention:  retention,
+		statuses:   make(map[string]*RequestStatus),
+		inProgress: make(map[string]bool),
+		pending:    make(map[string]time.Time),
+	}
+	if err := index.load(); err != nil {
+		return nil, err
+	}
+	if err := index.compact(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Compact removes final statuses which are not updated during retention period
+// and rewrites log with actual statuses.
+func (i *StatusIndex) Compact() error {
+	if i == nil {
+		return nil
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.compact()
+}
+
+func (i *StatusIndex) Close() error {
+	if i == nil {
+		return nil
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.file.Close()
+}
+
+// SetPosition marks request as queued and saves its position.
+func (i *StatusIndex) SetPosition(id string, chunk string, record int) error {
+	return i.update(&RequestStatus{ID: id, Status: QueuedStatus, Chunk: chunk, Record: record})
+}
+
+// SetFinal saves final status (delivered or dead-lettered) of request.
+func (i *StatusIndex) SetFinal(id string, status string, upstreamStatus int) error {
+	if i == nil {
+		return nil
+	}
+	i.mutex.Lock()
+	current, exist := i.statuses[id]
+	i.mutex.Unlock()
+
+	final := &RequestStatus{ID: id, Status: status, UpstreamStatus: upstreamStatus}
+	if exist {
+		final.Chunk, final.Record = current.Chunk, current.Record
+	}
+	return i.update(final)
+}
+
+func (i *StatusIndex) SetInProgress(id string, inProgress bool) {
+	if i == nil {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if inProgress {
+		i.inProgress[id] = true
+	} else {
+		delete(i.inProgress, id)
+	}
+}
+
+// SetPending marks request which is added to storer, but is not written to chunk
+// yet. Mark is removed when position or final status of request is saved.
+func (i *StatusIndex) SetPending(id string, pending bool) {
+	if i == nil || id == "" {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if pending {
+		i.pending[id] = time.Now()
+	} else {
+		delete(i.pending, id)
+	}
+}
+
+func (i *StatusIndex) Get(id string) (RequestStatus, bool) {
+	if i == nil {
+		return RequestStatus{}, false
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	status, exist := i.statuses[id]
+	if !exist {
+		if added, pending := i.pending[id]; pending {
+			return RequestStatus{ID: id, Status: QueuedStatus, Updated: added}, true
+		}
+		return RequestStatus{}, false
+	}
+	result := *status
+	if i.inProgress[id] && result.Status == QueuedStatus {
+		result.Status = InProgressStatus
+	}
+	return result, true
+}
+
+func (i *StatusIndex) update(status *RequestStatus) error {
+	if i == nil || status.ID == "" {
+		return nil
+	}
+	status.Updated = time.Now()
+	data, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode request status")
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.statuses[status.ID] = status
+	delete(i.pending, status.ID)
+	if _, err := i.file.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "cannot write status index")
+	}
+	if time.Since(i.lastCompact) >= cleanupPeriod {
+		return i.compact()
+	}
+	return nil
+}
+
+func (i *StatusIndex) load() error {
+	file, err := os.Open(i.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "cannot open status index '%s'", i.path)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		status := &RequestStatus{}
+		if err := decoder.Decode(status); err != nil {
+			// Tail of log may be lost on crash, statuses before it are kept.
+			break
+		}
+		i.statuses[status.ID] = status
+	}
+	return nil
+}
+
+// compact removes old final statuses and writes actual ones to new log which
+// replaces old one.
+func (i *StatusIndex) compact() error {
+	now := time.Now()
+	notBefore := now.Add(-i.retention)
+	for id, status := range i.statuses {
+		final := status.Status == DeliveredStatus || status.Status == DeadLetteredStatus
+		if final && status.Updated.Before(notBefore) {
+			delete(i.statuses, id)
+		}
+	}
+
+	tmpPath := i.path + tmpSuffix
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create status index '%s'", tmpPath)
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, status := range i.statuses {
+		if err := encoder.Encode(status); err != nil {
+			file.Close()
+			return errors.Wrapf(err, "cannot write status index '%s'", tmpPath)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "cannot write status index '%s'", tmpPath)
+	}
+	if err := os.Rename(tmpPath, i.path); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "cannot replace status index '%s'", i.path)
+	}
+	if i.file != nil {
+		i.file.Close()
+	}
+	i.file = file
+	i.lastCompact = now
+	return nil
+}
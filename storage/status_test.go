@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for status index tests.
+func openTestStatusIndex(t *testing.T, storagePath string, retention time.Duration) *StatusIndex {
+	index, err := OpenStatusIndex(storagePath, retention)
+	require.NoError(t, err, "cannot open status index")
+	return index
+}
+
+func requireStatus(t *testing.T, index *StatusIndex, id string, expectedStatus string) RequestStatus {
+	status, exist := index.Get(id)
+	require.True(t, exist, "status of '%s' must exist", id)
+	require.Equal(t, expectedStatus, status.Status, "incorrect status of '%s'", id)
+	return status
+}
+
+// Status index tests.
+func TestStatusIndex(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		index := openTestStatusIndex(t, storagePath, time.Hour)
+		require.NoError(t, index.SetPosition("first", "chunk", 1), "cannot set position")
+		require.NoError(t, index.SetPosition("second", "chunk", 2), "cannot set position")
+		require.NoError(t, index.SetPosition("third", "chunk", 3), "cannot set position")
+
+		status := requireStatus(t, index, "first", QueuedStatus)
+		require.Equal(t, "chunk", status.Chunk, "incorrect chunk of record")
+		require.Equal(t, 1, status.Record, "incorrect position of record")
+
+		index.SetInProgress("first", true)
+		requireStatus(t, index, "first", InProgressStatus)
+		index.SetInProgress("first", false)
+		requireStatus(t, index, "first", QueuedStatus)
+
+		require.NoError(t, index.SetFinal("first", DeliveredStatus, 200), "cannot set final status")
+		require.NoError(t, index.SetFinal("second", DeadLetteredStatus, 503), "cannot set final status")
+		_, exist := index.Get("unknown")
+		require.False(t, exist, "status of unknown request must not exist")
+		require.NoError(t, index.Close(), "cannot close status index")
+
+		// Statuses must be kept after reopening.
+		index = openTestStatusIndex(t, storagePath, time.Hour)
+		status = requireStatus(t, index, "first", DeliveredStatus)
+		require.Equal(t, 200, status.UpstreamStatus, "incorrect upstream status")
+		require.Equal(t, 1, status.Record, "position of record must be kept")
+		status = requireStatus(t, index, "second", DeadLetteredStatus)
+		require.Equal(t, 503, status.UpstreamStatus, "incorrect upstream status")
+		requireStatus(t, index, "third", QueuedStatus)
+		require.NoError(t, index.Close(), "cannot close status index")
+	})
+}
+
+func TestStatusIndexRetention(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		index := openTestStatusIndex(t, storagePath, time.Hour)
+		require.NoError(t, index.SetFinal("first", DeliveredStatus, 200), "cannot set final status")
+		require.NoError(t, index.SetFinal("second", DeadLetteredStatus, 503), "cannot set final status")
+		require.NoError(t, index.Close(), "cannot close status index")
+
+		index = openTestStatusIndex(t, storagePath, 0)
+		_, exist := index.Get("first")
+		require.False(t, exist, "old delivered status must be removed")
+		_, exist = index.Get("second")
+		require.False(t, exist, "old dead-lettered status must be removed")
+		require.NoError(t, index.Close(), "cannot close status index")
+
+		info, err := os.Stat(filepath.Join(storagePath, statusIndexName))
+		require.NoError(t, err, "cannot get size of status index")
+		require.Zero(t, info.Size(), "status index must be compacted")
+	})
+}
+
+func TestStatusIndexRetentionKeepsQueued(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		index := openTestStatusIndex(t, storagePath, time.Hour)
+		require.NoError(t, index.SetPosition("first", "chunk", 1), "cannot set position")
+		require.NoError(t, index.Close(), "cannot close status index")
+
+		// Request may wait for repeat longer than retention period.
+		index = openTestStatusIndex(t, storagePath, 0)
+		status := requireStatus(t, index, "first", QueuedStatus)
+		require.Equal(t, 1, status.Record, "position of queued request must be kept")
+		require.NoError(t, index.SetFinal("first", DeliveredStatus, 200), "cannot set final status")
+		require.NoError(t, index.Compact(), "cannot compact status index")
+		_, exist := index.Get("first")
+		require.False(t, exist, "finished status must be removed")
+		require.NoError(t, index.Close(), "cannot close status index")
+	})
+}
+
+func TestStatusIndexCompact(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		index := openTestStatusIndex(t, storagePath, 100*time.Millisecond)
+		require.NoError(t, index.SetFinal("first", DeliveredStatus, 200), "cannot set final status")
+		time.Sleep(200 * time.Millisecond)
+		require.NoError(t, index.SetPosition("second", "chunk", 2), "cannot set position")
+		require.NoError(t, index.Compact(), "cannot compact status index")
+
+		_, exist := index.Get("first")
+		require.False(t, exist, "old status must be removed")
+		requireStatus(t, index, "second", QueuedStatus)
+		require.NoError(t, index.SetFinal("second", DeliveredStatus, 200), "cannot set final status")
+		require.NoError(t, index.Close(), "cannot close status index")
+
+		// Compacted log must contain only actual statuses and updates after compaction.
+		index = openTestStatusIndex(t, storagePath, time.Hour)
+		_, exist = index.Get("first")
+		require.False(t, exist, "old status must not be restored")
+		requireStatus(t, index, "second", DeliveredStatus)
+		require.NoError(t, index.Close(), "cannot close status index")
+	})
+}
+
+func TestStatusIndexPending(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		index := openTestStatusIndex(t, storagePath, time.Hour)
+		index.SetPending("first", true)
+		index.SetPending("second", true)
+		requireStatus(t, index, "first", QueuedStatus)
+
+		require.NoError(t, index.SetPosition("first", "chunk", 1), "cannot set position")
+		status := requireStatus(t, index, "first", QueuedStatus)
+		require.Equal(t, "chunk", status.Chunk, "position must replace pending status")
+		index.SetPending("second", false)
+		_, exist := index.Get("second")
+		require.False(t, exist, "status of request which is not stored must not exist")
+		require.NoError(t, index.Close(), "cannot close status index")
+	})
+}
+
+func TestStorerTracksRecords(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		logger := createStorerLogger(t)
+		index := openTestStatusIndex(t, storagePath, time.Hour)
+		storer, err := StartStorer(logger, storagePath, 3, time.Hour, 10, nil, index)
+		require.NoError(t, err, "cannot start storer")
+
+		first, second := chunkTestStringData("first"), chunkTestStringData("second")
+		third := chunkTestStringData("third")
+		require.NoError(t, storer.AddTracked(&first, "first", 1), "cannot add data to storer")
+		require.NoError(t, storer.AddTracked(&second, "second", 6), "cannot add data to storer")
+		require.NoError(t, storer.AddTracked(&third, "third", 0), "cannot add data to storer")
+		// Added request is queued even if it is not written yet.
+		requireStatus(t, index, "third", QueuedStatus)
+		storer.Stop()
+
+		chunks, err := ListChunks(storagePath)
+		require.NoError(t, err, "cannot list chunks")
+		require.Len(t, chunks, 1, "data must be stored to one chunk")
+		status := requireStatus(t, index, "second", QueuedStatus)
+		require.Equal(t, chunks[0], status.Chunk, "incorrect chunk of record")
+		require.Equal(t, 1, status.Record, "incorrect position of record")
+		require.NoError(t, index.Close(), "cannot close status index")
+
+		// Attempts after the first one decrease TTL, but record is repeated at least once.
+		chunk := openTestChunk(t, chunks[0], nil)
+		require.EqualValues(t, 3, chunk.Index.Records[0].TTL, "incorrect TTL of record after one attempt")
+		require.False(t, chunk.Index.Records[0].LastTry.IsZero(), "time of attempt must be set")
+		require.EqualValues(t, 1, chunk.Index.Records[1].TTL, "incorrect TTL of retried record")
+		require.EqualValues(t, 3, chunk.Index.Records[2].TTL, "incorrect TTL of record without attempts")
+		require.True(t, chunk.Index.Records[2].LastTry.IsZero(), "record without attempts must not be delayed")
+		closeTestChunk(t, chunk)
+	})
+}
@@ -3,6 +3,8 @@ package storage
 import (
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lyobzik/go-utils"
@@ -16,9 +18,39 @@ type Data interface {
 }
 
 type DataRecord struct {
-	Data    Data
-	TTL     int32
-	LastTry time.Time
+	Data       Data
+	TTL        int32
+	LastTry    time.Time
+	TrackingID string // position of record is saved to status index if it is set
+	stored     chan storeResult
+}
+
+// RecordPosition is position of record in chunk.
+type RecordPosition struct {
+	Chunk  string
+	Record int
+}
+
+type storeResult struct {
+	position RecordPosition
+	err      error
+}
+
+// pendingChunk is chunk with records which are stored ahead and are not
+// finished yet. Such chunk is not finalized until all its records are finished.
+type pendingChunk struct {
+	chunk    *Chunk
+	records  map[int]bool
+	draining bool // chunk is replaced by new chunk and is finalized when it is finished
+}
+
+// StorerState is state of storer which is used to check its readiness.
+type StorerState struct {
+	Running         bool
+	Queued          int
+	Capacity        int
+	FinalizedChunks int
+	ChunksCapacity  int
 }
 
 type Storer struct {
@@ -26,13 +58,30 @@ type Storer struct {
 	storage       string
 	repeatNumber  int32
 	chunkLifetime time.Duration
+	codec         *Codec
+	statusIndex   *StatusIndex
+	statsMutex    sync.Mutex
+	stats         StoreStats
+	dataMutex     sync.RWMutex
+	stopped       bool
+	running       int32
 	data          chan DataRecord
+	finished      chan finishedRecord
+	pending       map[string]*pendingChunk // it is used only by store loop
+	done          chan struct{}            // it is closed when store loop exits
 	stopper       *utils.Stopper
 	Chunks        chan string
 }
 
+type finishedRecord struct {
+	position  RecordPosition
+	delivered bool
+	attempts  int32
+}
+
 func NewStorer(logger *logging.Logger, storage string, repeatNumber int32,
-	chunkLifetime time.Duration, bufferSize int) (*Storer, error) {
+	chunkLifetime time.Duration, bufferSize int, codec *Codec,
+	statusIndex *StatusIndex) (*Storer, error) {
 
 	if err := utils.EnsureDir(storage); err != nil {
 		return nil, errors.Wrap(err, "cannot create storage directory")
@@ -42,16 +91,23 @@ func NewStorer(logger *logging.Logger, storage string, repeatNumber int32,
 		storage:       storage,
 		repeatNumber:  repeatNumber,
 		chunkLifetime: chunkLifetime,
+		codec:         codec,
+		statusIndex:   statusIndex,
 		data:          make(chan DataRecord, bufferSize),
+		finished:      make(chan finishedRecord, bufferSize),
+		pending:       make(map[string]*pendingChunk),
+		done:          make(chan struct{}),
 		stopper:       utils.NewStopper(),
 		Chunks:        make(chan string, bufferSize),
 	}, nil
 }
 
 func StartStorer(logger *logging.Logger, storage string, repeatNumber int32,
-	chunkLifetime time.Duration, bufferSize int) (*Storer, error) {
+	chunkLifetime time.Duration, bufferSize int, codec *Codec,
+	statusIndex *StatusIndex) (*Storer, error) {
 
-	storer, err := NewStorer(logger, storage, repeatNumber, chunkLifetime, bufferSize)
+	storer, err := NewStorer(logger, storage, repeatNumber, chunkLifetime, bufferSize, codec,
+		statusIndex)
 	if err == nil {
 		storer.Spawn()
 	}
@@ -63,61 +119,236 @@ func (s *Storer) Spawn() {
 	go s.storeLoop()
 }
 
+// Stop stops accepting of new data, stores all accepted data and finalizes chunk.
 func (s *Storer) Stop() {
+	s.dataMutex.Lock()
+	s.stopped = true
 	close(s.data)
+	s.dataMutex.Unlock()
+
 	s.stopper.Stop()
 	s.stopper.WaitDone()
 }
 
-func (s *Storer) Add(data Data) {
-	s.AddWithTTL(data, s.repeatNumber)
+// Codec returns codec of stored data, it must be used to open chunks of storer.
+func (s *Storer) Codec() *Codec {
+	return s.codec
 }
 
-func (s *Storer) AddWithTTL(data Data, ttl int32) {
-	s.data <- DataRecord{Data: data, TTL: ttl, LastTry: time.Now()}
+// StatusIndex returns index of statuses of tracked records, it may be nil.
+func (s *Storer) StatusIndex() *StatusIndex {
+	return s.statusIndex
 }
 
-func (s *Storer) storeLoop() {
-	finalizedChunks, err := utils.GetFilteredFiles(s.storage,
-		".*"+strings.Replace(indexSuffix, ".", "\\.", -1))
+// Stats returns stats of data stored to finalized chunks since start of storer.
+func (s *Storer) Stats() StoreStats {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	return s.stats
+}
+
+// State returns state of store loop and fill of its channels.
+func (s *Storer) State() StorerState {
+	return StorerState{
+		Running:         atomic.LoadInt32(&s.running) != 0,
+		Queued:          len(s.data),
+		Capacity:        cap(s.data),
+		FinalizedChunks: len(s.Chunks),
+		ChunksCapacity:  cap(s.Chunks),
+	}
+}
+
+func (s *Storer) Add(data Data) error {
+	return s.AddWithTTL(data, s.repeatNumber)
+}
+
+func (s *Storer) AddWithTTL(data Data, ttl int32) error {
+	return s.AddRecord(DataRecord{Data: data, TTL: ttl, LastTry: time.Now()})
+}
+
+// AddTracked adds data which status is tracked by status index. Attempts which
+// are already made decrease TTL of record, data without attempts is repeated
+// without waiting of repeat timeout.
+func (s *Storer) AddTracked(data Data, trackingID string, attempts int32) error {
+	record := DataRecord{Data: data, TTL: s.AttemptsTTL(attempts), TrackingID: trackingID}
+	if attempts > 0 {
+		record.LastTry = time.Now()
+	}
+	// Record is written asynchronously, so request is reported as queued before it.
+	s.statusIndex.SetPending(trackingID, true)
+	if err := s.AddRecord(record); err != nil {
+		s.statusIndex.SetPending(trackingID, false)
+		return err
+	}
+	return nil
+}
+
+// AttemptsTTL returns TTL of record after attempts which are already made, the
+// first attempt is original one and the rest are counted as repeated. Record is
+// repeated at least once, even if attempts exceed repeat number.
+func (s *Storer) AttemptsTTL(attempts int32) int32 {
+	ttl := s.repeatNumber
+	if attempts > 1 {
+		ttl -= attempts - 1
+	}
+	if ttl > 0 {
+		return ttl
+	}
+	return 1
+}
+
+// AddAhead adds data which is stored before it is handled. It returns when data
+// is written and synced to chunk, so data is not lost even if process crashes.
+// Each stored record must be finished by Finish, chunk with unfinished records
+// is not finalized. Storer owns data even if it is not stored.
+func (s *Storer) AddAhead(data Data) (RecordPosition, error) {
+	stored := make(chan storeResult, 1)
+	err := s.AddRecord(DataRecord{Data: data, TTL: s.repeatNumber, LastTry: time.Now(),
+		stored: stored})
 	if err != nil {
-		s.logger.Errorf("cannot read inialized chunk list: %v", err)
+		data.Close()
+		return RecordPosition{}, err
+	}
+	result := <-stored
+	return result.position, result.err
+}
+
+// Finish finishes record which is stored ahead. Delivered record becomes
+// inactive, otherwise it is repeated as usual record and attempts which are
+// already made decrease its TTL. Record which is finished after stop of storer
+// stays active, so it is repeated after restart.
+func (s *Storer) Finish(position RecordPosition, delivered bool, attempts int32) {
+	s.dataMutex.RLock()
+	defer s.dataMutex.RUnlock()
+
+	if s.stopped {
 		return
 	}
-	s.logger.Infof("finalized chunks on startup: %v", finalizedChunks)
+	// Chunk of record is already finalized if store loop exits.
+	select {
+	case s.finished <- finishedRecord{position: position, delivered: delivered, attempts: attempts}:
+	case <-s.done:
+	}
+}
 
-	chunk := s.createChunk()
+// AddRecord adds record as is, it allows to keep LastTry of imported records.
+// Storer owns data of added record, but if record is not added (storer is
+// stopped or its store loop exits) data is kept by caller.
+func (s *Storer) AddRecord(record DataRecord) error {
+	s.dataMutex.RLock()
+	defer s.dataMutex.RUnlock()
+
+	if s.stopped {
+		return errors.New("storer is stopped")
+	}
+	// Record is not added if store loop exits even if there is place in buffer.
+	select {
+	case <-s.done:
+		return errors.New("store loop is not running")
+	default:
+	}
+	select {
+	case s.data <- record:
+		return nil
+	case <-s.done:
+		return errors.New("store loop is not running")
+	}
+}
+
+func (s *Storer) storeLoop() {
+	atomic.StoreInt32(&s.running, 1)
+
+	var chunk *Chunk
 	defer func() {
+		// Records which are finished after stop stay active.
+		for len(s.finished) > 0 {
+			s.finishRecord(<-s.finished)
+		}
+		for path, pending := range s.pending {
+			if chunk == nil || path != chunk.Path {
+				s.finalizeChunk(pending.chunk)
+			}
+		}
 		s.finalizeChunk(chunk)
+		close(s.done)
+		s.dropData()
+		// Loop is not running when Stop returns.
+		atomic.StoreInt32(&s.running, 0)
 		s.stopper.Done()
 	}()
 
+	recovered, err := RecoverChunks(s.storage)
+	if err != nil {
+		s.logger.Errorf("cannot recover chunks: %v", err)
+	}
+	if len(recovered) > 0 {
+		s.logger.Warningf("chunks which are not finalized are recovered: %v", recovered)
+	}
+
+	finalizedChunks, err := utils.GetFilteredFiles(s.storage,
+		".*"+strings.Replace(indexSuffix, ".", "\\.", -1))
+	if err != nil {
+		s.logger.Errorf("cannot read inialized chunk list: %v", err)
+		return
+	}
+	s.logger.Infof("finalized chunks on startup: %v", finalizedChunks)
+
+	chunk = s.createChunk()
 	timer := time.Tick(s.chunkLifetime)
 
 	mayRun := true
 	for mayRun && chunk != nil {
-		if len(finalizedChunks) == 0 {
-			select {
-			case data, received := <-s.data:
-				mayRun = s.handleData(chunk, data, received)
-			case <-timer:
-				if chunk.Index.Header.ActiveCount > 0 {
-					finalizedChunks = append(finalizedChunks, chunk.Path)
-				}
-				chunk = s.recreateChunk(chunk)
+		// Finalized chunks are sent only if there are any.
+		var chunks chan string
+		var nextChunk string
+		if len(finalizedChunks) > 0 {
+			chunks, nextChunk = s.Chunks, finalizedChunks[0]
+		}
+		select {
+		case data, received := <-s.data:
+			mayRun = s.handleData(chunk, data, received)
+		case record := <-s.finished:
+			if path, finalized := s.finishRecord(record); finalized {
+				finalizedChunks = append(finalizedChunks, path)
+			}
+		case <-timer:
+			if pending, exist := s.pending[chunk.Path]; exist {
+				// Chunk is finalized when all its records are finished.
+				pending.draining = true
+				chunk = s.createChunk()
+				break
+			}
+			if chunk.Index.Header.ActiveCount > 0 {
+				finalizedChunks = append(finalizedChunks, chunk.Path)
 			}
-		} else {
-			select {
-			case data, received := <-s.data:
-				mayRun = s.handleData(chunk, data, received)
-			case <-timer:
-				if chunk.Index.Header.ActiveCount > 0 {
-					finalizedChunks = append(finalizedChunks, chunk.Path)
-				}
-				chunk = s.recreateChunk(chunk)
-			case s.Chunks <- finalizedChunks[0]:
-				finalizedChunks = finalizedChunks[1:]
+			chunk = s.recreateChunk(chunk)
+		case chunks <- nextChunk:
+			finalizedChunks = finalizedChunks[1:]
+		}
+	}
+}
+
+// dropData closes data which is accepted, but is not stored because store loop
+// exits before stop of storer (e.g. chunk cannot be created). Data which is
+// added ahead gets error.
+func (s *Storer) dropData() {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	for {
+		select {
+		case data, received := <-s.data:
+			if !received {
+				return
+			}
+			s.logger.Errorf("data is not stored, store loop is not running")
+			s.statusIndex.SetPending(data.TrackingID, false)
+			data.Data.Close()
+			if data.stored != nil {
+				data.stored <- storeResult{err: errors.New("store loop is not running")}
 			}
+		default:
+			return
 		}
 	}
 }
@@ -129,10 +360,58 @@ func (s *Storer) handleData(chunk *Chunk, data DataRecord, received bool) bool {
 	defer data.Data.Close()
 	if err := chunk.Store(data); err != nil {
 		s.logger.Errorf("cannot store data to chunk: %v", err)
+		s.statusIndex.SetPending(data.TrackingID, false)
+		if data.stored != nil {
+			data.stored <- storeResult{err: err}
+		}
+		return true
+	}
+	position := RecordPosition{Chunk: chunk.Path, Record: len(chunk.Index.Records) - 1}
+	if data.TrackingID != "" {
+		err := s.statusIndex.SetPosition(data.TrackingID, position.Chunk, position.Record)
+		if err != nil {
+			s.logger.Errorf("cannot save status of record: %v", err)
+		}
+	}
+	if data.stored != nil {
+		chunk.Flush()
+		pending, exist := s.pending[chunk.Path]
+		if !exist {
+			pending = &pendingChunk{chunk: chunk, records: make(map[int]bool)}
+			s.pending[chunk.Path] = pending
+		}
+		pending.records[position.Record] = true
+		data.stored <- storeResult{position: position}
 	}
 	return true
 }
 
+// finishRecord finishes record which is stored ahead. It returns path of chunk
+// and true if chunk with active records is finalized.
+func (s *Storer) finishRecord(record finishedRecord) (string, bool) {
+	path := record.position.Chunk
+	pending, exist := s.pending[path]
+	if !exist || !pending.records[record.position.Record] {
+		s.logger.Errorf("record %d of chunk '%s' is not pending", record.position.Record, path)
+		return path, false
+	}
+	delete(pending.records, record.position.Record)
+	if record.delivered {
+		pending.chunk.UpdateRecord(record.position.Record, true, time.Now())
+	} else if record.attempts > 1 {
+		pending.chunk.SetTTL(record.position.Record, s.AttemptsTTL(record.attempts))
+	}
+	if len(pending.records) > 0 {
+		return path, false
+	}
+	delete(s.pending, path)
+	if !pending.draining {
+		return path, false
+	}
+	active := pending.chunk.Index.Header.ActiveCount > 0
+	return path, s.finalizeChunk(pending.chunk) && active
+}
+
 func (s *Storer) recreateChunk(chunk *Chunk) *Chunk {
 	if s.finalizeChunk(chunk) {
 		return s.createChunk()
@@ -141,7 +420,7 @@ func (s *Storer) recreateChunk(chunk *Chunk) *Chunk {
 }
 
 func (s *Storer) createChunk() *Chunk {
-	chunk, err := CreateChunk(s.storage)
+	chunk, err := CreateChunk(s.storage, s.codec)
 	if err != nil {
 		s.logger.Errorf("cannot create new chunk: %v", err)
 		return nil
@@ -151,6 +430,8 @@ func (s *Storer) createChunk() *Chunk {
 
 func (s *Storer) finalizeChunk(chunk *Chunk) bool {
 	if chunk != nil {
+		s.updateStats(chunk.Stats)
+		chunk.Flush()
 		if err := chunk.Finalize(); err != nil {
 			s.logger.Errorf("cannot finalize chunk: %v", err)
 			return false
@@ -158,3 +439,15 @@ func (s *Storer) finalizeChunk(chunk *Chunk) bool {
 	}
 	return true
 }
+
+func (s *Storer) updateStats(stats StoreStats) {
+	if stats.Records == 0 {
+		return
+	}
+	s.logger.Infof("store %d records (%d bytes) with compression ratio %.2f",
+		stats.Records, stats.RawSize, stats.CompressionRatio())
+
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	s.stats.Merge(stats)
+}
@@ -53,7 +53,7 @@ func addValuesToTestStorer(t *testing.T, storer *Storer, values []string) {
 func TestCreateStorer(t *testing.T) {
 	runStorerTest(t, func(storagePath string) {
 		logger := createStorerLogger(t)
-		_, err := NewStorer(logger, storagePath, 1, 0, 0)
+		_, err := NewStorer(logger, storagePath, 1, 0, 0, nil, nil)
 		require.NoError(t, err, "cannot create storer")
 	})
 }
@@ -61,7 +61,7 @@ func TestCreateStorer(t *testing.T) {
 func TestRunAndStopStorer(t *testing.T) {
 	runStorerTest(t, func(storagePath string) {
 		logger := createStorerLogger(t)
-		storer, err := StartStorer(logger, storagePath, 1, 0, 0)
+		storer, err := StartStorer(logger, storagePath, 1, 0, 0, nil, nil)
 		require.NoError(t, err, "cannot start storer")
 		storer.Stop()
 	})
@@ -73,7 +73,7 @@ func TestAddDataToStorer(t *testing.T) {
 
 	runStorerTest(t, func(storagePath string) {
 		logger := createStorerLogger(t)
-		storer, err := StartStorer(logger, storagePath, 1, chunkLifetime, 1)
+		storer, err := StartStorer(logger, storagePath, 1, chunkLifetime, 1, nil, nil)
 		require.NoError(t, err, "cannot start storer")
 		// Append records to one chunk.
 		addValuesToTestStorer(t, storer, expectedValues)
@@ -86,7 +86,7 @@ func TestAddDataToStorer(t *testing.T) {
 
 		chunkName := <-storer.Chunks
 
-		chunk := openTestChunk(t, chunkName)
+		chunk := openTestChunk(t, chunkName, nil)
 		i := 0
 		chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
 			data, err := chunk.Restore(record)
@@ -100,3 +100,135 @@ func TestAddDataToStorer(t *testing.T) {
 		storer.Stop()
 	})
 }
+
+func TestAddDataToStoppedStorer(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		logger := createStorerLogger(t)
+		storer, err := StartStorer(logger, storagePath, 1, time.Hour, 10, nil, nil)
+		require.NoError(t, err, "cannot start storer")
+
+		data := chunkTestStringData("test")
+		require.NoError(t, storer.Add(&data), "cannot add data to storer")
+		storer.Stop()
+		require.Error(t, storer.Add(&data), "data must not be added to stopped storer")
+
+		// Accepted data must be stored to finalized chunk on stop.
+		chunks, err := ListChunks(storagePath)
+		require.NoError(t, err, "cannot list chunks")
+		require.Len(t, chunks, 1, "accepted data must be stored on stop")
+		chunk := openTestChunk(t, chunks[0], nil)
+		require.EqualValues(t, 1, chunk.Index.Header.ActiveCount, "incorrect count of stored records")
+		chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
+			return true
+		})
+		closeTestChunk(t, chunk)
+	})
+}
+
+func TestAddDataToFailedStorer(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		logger := createStorerLogger(t)
+		storer, err := NewStorer(logger, storagePath, 1, time.Hour, 1, nil, nil)
+		require.NoError(t, err, "cannot create storer")
+		// Store loop exits because storage directory does not exist.
+		require.NoError(t, os.RemoveAll(storagePath), "cannot remove test storage")
+		storer.Spawn()
+
+		data := chunkTestStringData("test")
+		for i := 0; i < 100 && storer.Add(&data) == nil; i += 1 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Error(t, storer.Add(&data), "data must not be added if store loop is not running")
+		_, err = storer.AddAhead(&data)
+		require.Error(t, err, "data must not be added ahead if store loop is not running")
+		storer.Finish(RecordPosition{}, true, 1)
+		storer.Stop()
+	})
+}
+
+func TestStorerState(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		logger := createStorerLogger(t)
+		storer, err := StartStorer(logger, storagePath, 1, time.Hour, 10, nil, nil)
+		require.NoError(t, err, "cannot start storer")
+
+		state := storer.State()
+		for i := 0; i < 100 && !state.Running; i += 1 {
+			time.Sleep(10 * time.Millisecond)
+			state = storer.State()
+		}
+		require.True(t, state.Running, "store loop must be running")
+		require.Equal(t, 10, state.Capacity, "incorrect capacity of storer")
+		require.Equal(t, 10, state.ChunksCapacity, "incorrect capacity of chunks queue")
+
+		storer.Stop()
+		require.False(t, storer.State().Running, "store loop must be stopped")
+	})
+}
+
+func TestAddAheadToStorer(t *testing.T) {
+	chunkLifetime := 10 * time.Millisecond
+
+	runStorerTest(t, func(storagePath string) {
+		logger := createStorerLogger(t)
+		storer, err := StartStorer(logger, storagePath, 3, chunkLifetime, 10, nil, nil)
+		require.NoError(t, err, "cannot start storer")
+
+		delivered, failed := chunkTestStringData("delivered"), chunkTestStringData("failed")
+		deliveredPosition, err := storer.AddAhead(&delivered)
+		require.NoError(t, err, "cannot add data ahead")
+		failedPosition, err := storer.AddAhead(&failed)
+		require.NoError(t, err, "cannot add data ahead")
+		require.Equal(t, deliveredPosition.Chunk, failedPosition.Chunk, "records must be stored to one chunk")
+
+		// Chunk with pending records must not be finalized.
+		time.Sleep(3 * chunkLifetime)
+		require.Len(t, storer.Chunks, 0, "chunk with pending records must not be finalized")
+
+		storer.Finish(deliveredPosition, true, 1)
+		storer.Finish(failedPosition, false, 2)
+		chunkName := <-storer.Chunks
+		require.Equal(t, failedPosition.Chunk, chunkName, "incorrect finalized chunk")
+
+		chunk := openTestChunk(t, chunkName, nil)
+		require.EqualValues(t, 1, chunk.Index.Header.ActiveCount, "delivered record must be inactive")
+		chunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
+			data, err := chunk.Restore(record)
+			require.NoError(t, err, "cannot restore value from chunk")
+			require.Equal(t, "failed", string(data), "restore incorrect value")
+			require.EqualValues(t, 2, record.TTL, "attempts must decrease TTL")
+			return true
+		})
+		closeTestChunk(t, chunk)
+
+		storer.Stop()
+	})
+}
+
+func TestRecoverChunks(t *testing.T) {
+	runStorerTest(t, func(storagePath string) {
+		require.NoError(t, os.MkdirAll(storagePath, 0755), "cannot create test storage")
+		chunk := createTestChunk(t, storagePath, nil)
+		data := chunkTestStringData("test")
+		require.NoError(t, chunk.Store(DataRecord{Data: &data, TTL: 1}), "cannot store data")
+		chunk.Flush()
+		// Chunk is not finalized as if process crashed.
+		chunk.Index.Close()
+		chunk.dataFile.Close()
+		chunk.indexFile.Close()
+
+		recovered, err := RecoverChunks(storagePath)
+		require.NoError(t, err, "cannot recover chunks")
+		require.Equal(t, []string{chunk.Path}, recovered, "incorrect recovered chunks")
+		chunks, err := ListChunks(storagePath)
+		require.NoError(t, err, "cannot list chunks")
+		require.Equal(t, []string{chunk.Path}, chunks, "recovered chunk must be finalized")
+
+		recoveredChunk := openTestChunk(t, chunk.Path, nil)
+		require.EqualValues(t, 1, recoveredChunk.Index.Header.ActiveCount, "record must be recovered")
+		recoveredChunk.ForEachActiveRecord(0, func(chunk *Chunk, record IndexRecord) bool {
+			return true
+		})
+		closeTestChunk(t, recoveredChunk)
+	})
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Verify checks consistency of index and data of chunk and returns found problems.
+// Data of encrypted records is checked only if codec with keyring is set.
+func (c *Chunk) Verify() []error {
+	problems := []error{}
+	stat, err := c.dataFile.Stat()
+	if err != nil {
+		return append(problems, errors.Wrap(err, "cannot get stat of data file"))
+	}
+	dataSize := stat.Size()
+
+	var activeCount, end int64
+	for i, record := range c.Index.Records {
+		if record.TTL > 0 {
+			activeCount += 1
+		}
+		if record.Offset < 0 || record.Size < 0 || dataSize < record.Offset+record.Size {
+			problems = append(problems, errors.Errorf(
+				"record %d is out of data file (offset %d, size %d, data size %d)",
+				i, record.Offset, record.Size, dataSize))
+			continue
+		}
+		if record.Offset < end {
+			problems = append(problems, errors.Errorf("record %d overlaps previous record", i))
+		}
+		end = record.Offset + record.Size
+
+		if record.KeyID != NoKeyID && (c.Codec == nil || c.Codec.Keyring == nil) {
+			continue
+		}
+		if _, err := c.Restore(record); err != nil {
+			problems = append(problems, errors.Wrapf(err, "cannot restore record %d", i))
+		}
+	}
+	if activeCount != c.Index.Header.ActiveCount {
+		problems = append(problems, errors.Errorf("incorrect active count in header (%d != %d)",
+			c.Index.Header.ActiveCount, activeCount))
+	}
+	return problems
+}
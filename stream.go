@@ -2,31 +2,102 @@ package main
 
 import (
 	"github.com/lyobzik/go-utils"
+	"github.com/lyobzik/leska/middleware"
 	"github.com/lyobzik/leska/storage"
+	"github.com/lyobzik/leska/tracing"
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Streamer struct {
-	logger  *logging.Logger
-	storer  *storage.Storer
-	handler http.Handler
+	logger       *logging.Logger
+	storer       *storage.Storer
+	handler      http.Handler
+	redactor     *Redactor
+	accessLog    *AccessLog
+	tracer       *tracing.Tracer
+	notifier     *Notifier
+	tracker      *Tracker
+	acknowledger *Acknowledger
+	queueFilter  *QueueFilter
+	middlewares  middleware.Chain
+	mirrors      Mirrors
+	fanout       *Fanout
 }
 
-func NewStreamer(logger *logging.Logger, storer *storage.Storer, handler http.Handler) *Streamer {
+func NewStreamer(logger *logging.Logger, storer *storage.Storer, handler http.Handler,
+	redactor *Redactor, accessLog *AccessLog, tracer *tracing.Tracer,
+	notifier *Notifier, tracker *Tracker, acknowledger *Acknowledger,
+	queueFilter *QueueFilter, middlewares middleware.Chain, mirrors Mirrors,
+	fanout *Fanout) *Streamer {
+
 	return &Streamer{
-		logger:  logger,
-		storer:  storer,
-		handler: handler,
+		logger:       logger,
+		storer:       storer,
+		handler:      handler,
+		redactor:     redactor,
+		accessLog:    accessLog,
+		tracer:       tracer,
+		notifier:     notifier,
+		tracker:      tracker,
+		acknowledger: acknowledger,
+		queueFilter:  queueFilter,
+		middlewares:  middlewares,
+		mirrors:      mirrors,
+		fanout:       fanout,
 	}
 }
 
 func (s *Streamer) ServeHTTP(inResponse http.ResponseWriter, inRequest *http.Request) {
+	if s.tracker.IsStatusRequest(inRequest) {
+		s.tracker.ServeHTTP(inResponse, inRequest)
+		return
+	}
+
+	start := time.Now()
+	requestLog := &RequestLog{Attempt: 1}
+	// Request is rejected if it is not forwarded or queued.
+	action, status := RejectedAction, http.StatusInternalServerError
+	span := s.startSpan(inRequest)
+	defer func() {
+		s.accessLog.Log(NewAccessLogEntry(inRequest, start, requestLog, action, status))
+		span.SetAttribute("leska.request_id", requestLog.RequestID)
+		span.SetAttribute("leska.upstream", requestLog.Upstream)
+		span.SetAttribute("leska.action", action)
+		span.SetAttribute("http.status_code", status)
+		span.Finish()
+	}()
+
+	requestID, err := EnsureRequestID(inRequest)
+	if err != nil {
+		s.responseError(inResponse, requestLog, errors.Wrap(err, "cannot create request id"))
+		return
+	}
+	requestLog.RequestID = requestID
+	inResponse.Header().Set(RequestIDHeader, requestID)
+
+	// Callback is not forwarded to upstream, it is stored with request only if
+	// request is queued.
+	callbackURL, err := s.notifier.PopCallback(inRequest.Header)
+	if err != nil {
+		s.logger.Errorf("cannot handle request: %v: %v", err, requestLog)
+		status = http.StatusBadRequest
+		s.writeResponse(inResponse, status)
+		return
+	}
+	hookContext := &middleware.Context{Request: inRequest, RequestID: requestID, Attempt: 1}
+	if err := s.middlewares.OnReceive(hookContext); err != nil {
+		status = s.rejectRequest(inResponse, requestLog, err)
+		return
+	}
+
 	// TODO: возможно inRequest можно скопировать после неудачной попытке отправки.
 	request, response, err := s.copyRequestResponse(inRequest)
 	if err != nil {
-		s.responseError(inResponse, err)
+		s.responseError(inResponse, requestLog, err)
 		return
 	}
 
@@ -36,18 +107,366 @@ func (s *Streamer) ServeHTTP(inResponse http.ResponseWriter, inRequest *http.Req
 		response.Close()
 	}()
 
-	s.handler.ServeHTTP(response, &request.httpRequest)
+	hookContext.Request, hookContext.ReadBody = &request.httpRequest, request.ReadBody
+	if err := s.middlewares.BeforeForward(hookContext); err != nil {
+		status = s.rejectRequest(inResponse, requestLog, err)
+		return
+	}
+	s.mirrors.Send(request)
+
+	// Write-ahead request is stored before forwarding and stays stored until it
+	// is delivered, request of queue mode is only stored and is delivered by
+	// repeater. Fan-out request is stored separately for each destination, so
+	// it is stored after failure even in write-ahead mode.
+	queueable := s.queueFilter.IsQueueable(inRequest)
+	queueMode := s.queueFilter.Mode(inRequest)
+	destinations := s.fanout.Select(inRequest)
+	ack := s.acknowledger.Select(inRequest)
+	if queueable && queueMode == PureQueueMode {
+		if err := s.middlewares.BeforeStore(hookContext); err != nil {
+			s.logger.Warningf("request is not stored and is forwarded: %v: %v", err, requestLog)
+			queueable = false
+		} else {
+			var fanoutResult *FanoutResult
+			if len(destinations) > 0 {
+				fanoutResult = &FanoutResult{}
+				for _, destination := range destinations {
+					fanoutResult.Failed = append(fanoutResult.Failed, destination.name)
+				}
+			}
+			trackingID, err := s.queueRequest(request, callbackURL, start, fanoutResult, 0, span)
+			if err != nil {
+				s.responseError(inResponse, requestLog, err)
+				return
+			}
+			// Stored copies of fan-out request are closed by storer, request itself is not stored.
+			repeateRequest = fanoutResult == nil
+			action = QueuedAction
+			s.logger.Infof("request is queued without forwarding: %v", requestLog)
+			if status, err = s.acknowledge(inResponse, ack, nil, requestLog, trackingID); err != nil {
+				s.responseError(inResponse, requestLog, err)
+			}
+			return
+		}
+	}
+	var ahead *aheadRecord
+	if queueable && queueMode == WriteAheadQueueMode && len(destinations) == 0 {
+		if err := s.middlewares.BeforeStore(hookContext); err != nil {
+			s.logger.Warningf("request is not stored: %v: %v", err, requestLog)
+			queueable = false
+		} else if ahead, err = s.storeAhead(request, callbackURL, start, span); err != nil {
+			s.responseError(inResponse, requestLog, err)
+			return
+		}
+	}
+	if ahead != nil {
+		// Write-ahead request is repeated if it is not finished after forwarding
+		// (e.g. handler panics), otherwise its chunk is never finalized.
+		defer s.finishAhead(ahead, false, requestLog)
+	}
 
-	if response.IsFailed() {
-		s.writeResponse(inResponse, http.StatusAccepted)
-		s.storer.Add(request)
-		repeateRequest = true
+	var fanoutResult *FanoutResult
+	if len(destinations) > 0 {
+		fanoutResponse, result, err := s.fanout.Deliver(request, requestLog, destinations)
+		if err != nil {
+			s.responseError(inResponse, requestLog, err)
+			return
+		}
+		response.Close()
+		response, fanoutResult = fanoutResponse, result
+	} else {
+		ServeRequest(s.handler, response, request, requestLog)
+	}
+
+	// Request which cannot be queued gets upstream error.
+	queueable = queueable && response.IsFailed()
+	// Fan-out request is not held, only failed destinations are repeated.
+	if queueable && ack.Mode == HoldAckMode && fanoutResult == nil {
+		response, err = s.holdRequest(inRequest, request, response, requestLog, ack)
+		if err != nil {
+			s.responseError(inResponse, requestLog, err)
+			return
+		}
+	}
+	hookContext.StatusCode, hookContext.ResponseHeader = response.code, response.Header()
+	s.middlewares.AfterResponse(hookContext)
+	if ahead != nil {
+		// Delivered write-ahead request is removed from storage, failed one is repeated.
+		s.finishAhead(ahead, !response.IsFailed(), requestLog)
+	} else if queueable && response.IsFailed() {
+		if err := s.middlewares.BeforeStore(hookContext); err != nil {
+			s.logger.Warningf("request is not stored: %v: %v", err, requestLog)
+			queueable = false
+		}
+	}
+	if queueable && response.IsFailed() {
+		trackingID := ""
+		if ahead != nil {
+			trackingID = ahead.trackingID
+		} else {
+			attempts := int32(requestLog.Attempt)
+			trackingID, err = s.queueRequest(request, callbackURL, start, fanoutResult, attempts, span)
+			if err != nil {
+				s.responseError(inResponse, requestLog, err)
+				return
+			}
+			// Stored copies of fan-out request are closed by storer, request itself is not stored.
+			repeateRequest = fanoutResult == nil
+		}
+		action = QueuedAction
+		s.logger.Warningf("request is failed and stored to repeate: %v", requestLog)
+		if status, err = s.acknowledge(inResponse, ack, response, requestLog, trackingID); err != nil {
+			s.responseError(inResponse, requestLog, err)
+		}
 		return
 	}
+	if response.IsFailed() {
+		s.logger.Warningf("request is failed and cannot be queued: %v", requestLog)
+	} else {
+		s.logger.Infof("request is forwarded: %v", requestLog)
+	}
+	// Request id is already set, it must not be duplicated if upstream returns it.
+	response.Header().Del(RequestIDHeader)
 	if err := response.Copy(inResponse); err != nil {
-		s.responseError(inResponse, err)
+		s.responseError(inResponse, requestLog, err)
 		return
 	}
+	action, status = ForwardedAction, response.code
+}
+
+// startSpan starts span of request, traceparent of request is replaced by this
+// span, so upstream spans and spans of repeated attempts join the same trace.
+func (s *Streamer) startSpan(inRequest *http.Request) *tracing.Span {
+	parent, _ := tracing.ParseTraceparent(inRequest.Header.Get(tracing.TraceparentHeader))
+	span := s.tracer.Start("Streamer.ServeHTTP", tracing.ServerSpan, parent)
+	if span != nil {
+		inRequest.Header.Set(tracing.TraceparentHeader, span.SpanContext().Traceparent())
+		span.SetAttribute("http.method", inRequest.Method)
+		span.SetAttribute("http.target", inRequest.RequestURI)
+	}
+	return span
+}
+
+// queueRequest stores request to repeat it and returns its tracking id, fan-out
+// request is stored for each failed destination. Attempts which are already made
+// (including retries of hold mode) are stored with request, they decrease number
+// of repeated attempts.
+func (s *Streamer) queueRequest(request *Request, callbackURL string, start time.Time,
+	fanoutResult *FanoutResult, attempts int32, span *tracing.Span) (string, error) {
+
+	if callbackURL != "" {
+		request.httpRequest.Header.Set(CallbackHeader, callbackURL)
+	}
+	request.httpRequest.Header.Set(AttemptsHeader, strconv.Itoa(int(attempts)))
+	SetReceived(request, start)
+	trackingID, err := s.tracker.Track(request)
+	if err != nil {
+		return "", err
+	}
+	if fanoutResult != nil {
+		return trackingID, s.storeFanout(request, trackingID, fanoutResult, attempts, span)
+	}
+	return trackingID, s.storeRequest(request, trackingID, attempts, span)
+}
+
+// acknowledge writes acknowledgement of queued request, response is nil if
+// request is queued without forwarding.
+func (s *Streamer) acknowledge(inResponse http.ResponseWriter, ack *Acknowledgement,
+	response *Response, requestLog *RequestLog, trackingID string) (int, error) {
+
+	ackData := &AckData{RequestID: requestLog.RequestID, TrackingID: trackingID}
+	if response != nil {
+		ackData.UpstreamStatus = response.code
+	}
+	if trackingID != "" {
+		ackData.Location = s.tracker.Location(trackingID)
+	}
+	return ack.Write(inResponse, response, ackData)
+}
+
+func (s *Streamer) storeRequest(request *Request, trackingID string, attempts int32,
+	parent *tracing.Span) error {
+
+	// Sensitive data must not be stored, so request is rejected if it cannot be redacted.
+	if err := s.redactor.Redact(request); err != nil {
+		return err
+	}
+	return s.enqueueRequest(request, trackingID, attempts, parent)
+}
+
+// enqueueRequest adds redacted request to storer.
+func (s *Streamer) enqueueRequest(request *Request, trackingID string, attempts int32,
+	parent *tracing.Span) error {
+
+	// Storer writes record asynchronously, so span covers enqueueing only.
+	span := s.tracer.Start("Storer.Enqueue", tracing.InternalSpan, parent.SpanContext())
+	defer span.Finish()
+
+	err := s.storer.AddTracked(request, trackingID, attempts)
+	span.SetError(err)
+	return err
+}
+
+// aheadRecord is write-ahead request which is stored before forwarding.
+type aheadRecord struct {
+	trackingID string
+	position   storage.RecordPosition
+	finished   bool
+}
+
+// storeAhead stores copy of request before forwarding, the copy is prepared as
+// if request is queued after failure.
+func (s *Streamer) storeAhead(request *Request, callbackURL string, start time.Time,
+	parent *tracing.Span) (*aheadRecord, error) {
+
+	span := s.tracer.Start("Storer.AddAhead", tracing.InternalSpan, parent.SpanContext())
+	defer span.Finish()
+
+	aheadRequest, err := request.Clone()
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	if callbackURL != "" {
+		aheadRequest.httpRequest.Header.Set(CallbackHeader, callbackURL)
+	}
+	SetReceived(aheadRequest, start)
+	ahead := &aheadRecord{}
+	if ahead.trackingID, err = s.tracker.Track(aheadRequest); err == nil {
+		// Sensitive data must not be stored, so request is rejected if it cannot be redacted.
+		err = s.redactor.Redact(aheadRequest)
+	}
+	if err != nil {
+		aheadRequest.Close()
+		span.SetError(err)
+		return nil, err
+	}
+	// Request is tracked only if it is queued, so it is not added to status index here.
+	if ahead.position, err = s.storer.AddAhead(aheadRequest); err != nil {
+		span.SetError(err)
+		return nil, errors.Wrap(err, "cannot store request before forwarding")
+	}
+	return ahead, nil
+}
+
+// finishAhead removes delivered write-ahead request from storage, failed request
+// stays stored, it is tracked and repeated. Request is finished only once.
+func (s *Streamer) finishAhead(ahead *aheadRecord, delivered bool, requestLog *RequestLog) {
+	if ahead.finished {
+		return
+	}
+	ahead.finished = true
+	if !delivered {
+		// Request is tracked before it may be repeated.
+		if err := s.tracker.SetQueued(ahead.trackingID, ahead.position); err != nil {
+			s.logger.Errorf("cannot update status of request: %v: %v", err, requestLog)
+		}
+	}
+	// Retries of hold mode decrease number of repeated attempts.
+	s.storer.Finish(ahead.position, delivered, int32(requestLog.Attempt))
+}
+
+// storeFanout stores copy of request for each failed destination of fan-out,
+// destinations which accept request are marked as delivered. All copies are
+// prepared before storing, so request is not stored at all if any copy cannot
+// be prepared. Copy which cannot be added after another one is stored (e.g.
+// storer is stopped) is dead-lettered, so request is queued partially and its
+// status shows the lost destination.
+func (s *Streamer) storeFanout(request *Request, trackingID string, result *FanoutResult,
+	attempts int32, parent *tracing.Span) error {
+
+	requests := make([]*Request, 0, len(result.Failed))
+	for _, destination := range result.Failed {
+		destinationRequest, err := s.prepareFanoutRequest(request, trackingID, destination)
+		if err != nil {
+			for _, preparedRequest := range requests {
+				preparedRequest.Close()
+			}
+			return errors.Wrapf(err, "cannot prepare request to destination '%s'", destination)
+		}
+		requests = append(requests, destinationRequest)
+	}
+
+	stored := 0
+	var storeErr error
+	for i, destination := range result.Failed {
+		destinationID := destinationTrackingID(trackingID, destination)
+		if trackingID == "" {
+			destinationID = ""
+		}
+		if err := s.enqueueRequest(requests[i], destinationID, attempts, parent); err != nil {
+			requests[i].Close()
+			storeErr = errors.Wrapf(err, "cannot store request to destination '%s'", destination)
+			s.logger.Errorf("%v", storeErr)
+			if err := s.tracker.SetDeadLettered(destinationID, 0); err != nil {
+				s.logger.Errorf("cannot update status of destination '%s': %v", destination, err)
+			}
+			continue
+		}
+		stored += 1
+	}
+	if stored == 0 && storeErr != nil {
+		return storeErr
+	}
+	if trackingID == "" {
+		return nil
+	}
+	for destination, upstreamStatus := range result.Delivered {
+		err := s.tracker.SetDelivered(destinationTrackingID(trackingID, destination), upstreamStatus)
+		if err != nil {
+			s.logger.Errorf("cannot update status of destination '%s': %v", destination, err)
+		}
+	}
+	return nil
+}
+
+// prepareFanoutRequest returns redacted copy of request to destination.
+func (s *Streamer) prepareFanoutRequest(request *Request, trackingID string,
+	destination string) (*Request, error) {
+
+	destinationRequest, err := request.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if trackingID != "" {
+		destinationRequest.httpRequest.Header.Set(TrackingIDHeader,
+			destinationTrackingID(trackingID, destination))
+	}
+	destinationRequest.httpRequest.Header.Set(DestinationHeader, destination)
+	// Sensitive data must not be stored, so request is rejected if it cannot be redacted.
+	if err := s.redactor.Redact(destinationRequest); err != nil {
+		destinationRequest.Close()
+		return nil, err
+	}
+	return destinationRequest, nil
+}
+
+// holdRequest retries failed request until it is delivered or hold timeout is
+// expired, so client gets upstream response if upstream recovers quickly.
+func (s *Streamer) holdRequest(inRequest *http.Request, request *Request, response *Response,
+	requestLog *RequestLog, ack *Acknowledgement) (*Response, error) {
+
+	deadline := time.Now().Add(ack.HoldTimeout)
+	for response.IsFailed() && time.Now().Add(ack.HoldInterval).Before(deadline) {
+		select {
+		case <-time.After(ack.HoldInterval):
+		case <-inRequest.Context().Done():
+			// Client is gone, request is queued without waiting.
+			return response, nil
+		}
+		if err := request.Rewind(); err != nil {
+			return response, err
+		}
+		retryResponse, err := NewResponse()
+		if err != nil {
+			return response, errors.Wrap(err, "cannot create response")
+		}
+		response.Close()
+		response = retryResponse
+		requestLog.Attempt += 1
+		ServeRequest(s.handler, response, request, requestLog)
+	}
+	return response, nil
 }
 
 func (s *Streamer) copyRequestResponse(inRequest *http.Request) (*Request, *Response, error) {
@@ -75,9 +494,18 @@ func (s *Streamer) writeResponse(response http.ResponseWriter, statusCode int) {
 	response.Write([]byte(http.StatusText(statusCode)))
 }
 
-func (s *Streamer) responseError(response http.ResponseWriter, err error) {
+// rejectRequest writes response to request which is rejected by middleware and
+// returns its status.
+func (s *Streamer) rejectRequest(response http.ResponseWriter, requestLog *RequestLog, err error) int {
+	statusCode := middleware.StatusCode(err, http.StatusInternalServerError)
+	s.logger.Warningf("request is rejected: %v: %v", err, requestLog)
+	s.writeResponse(response, statusCode)
+	return statusCode
+}
+
+func (s *Streamer) responseError(response http.ResponseWriter, requestLog *RequestLog, err error) {
 	// TODO: подумать нужно ли логировать содержимое запроса (тело может быть большим), поэтому если
 	// TODO: и логировать, то только какие-то заголовки.
-	s.logger.Errorf("cannot handle request: %v")
+	s.logger.Errorf("cannot handle request: %v: %v", err, requestLog)
 	s.writeResponse(response, http.StatusInternalServerError)
 }
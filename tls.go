@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+// Files of certificate are checked at most once per interval, so handshakes
+// do not stat them every time.
+const certificateCheckInterval = 10 * time.Second
+
+type ListenerTLSConfig struct {
+	Cert     string `long:"cert" description:"path to certificate file, HTTPS is used if it is set"`
+	Key      string `long:"key" description:"path to private key file"`
+	ClientCA string `long:"client-ca" description:"path to CA bundle to verify client certificates, client certificate is required if it is set"`
+}
+
+// CreateServerTLSConfig creates TLS config of listener. Returns nil if TLS is not
+// configured. Certificate and key are reloaded when their files are changed, so
+// they may be rotated without restart.
+func CreateServerTLSConfig(logger *logging.Logger, config ListenerTLSConfig) (*tls.Config, error) {
+	if config.Cert == "" && config.Key == "" {
+		return nil, nil
+	}
+	if config.Cert == "" || config.Key == "" {
+		return nil, errors.New("both certificate and key must be set")
+	}
+
+	certificate, err := NewReloadableCertificate(logger, config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{GetCertificate: certificate.GetCertificate}
+	if config.ClientCA != "" {
+		if tlsConfig.ClientCAs, err = LoadCertPool(config.ClientCA); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Certificate which is reloaded on first handshake after change of its files
+// (files are checked at most once per certificateCheckInterval). Change is found
+// by hash of content, so rotation which keeps modification time is not missed.
+type ReloadableCertificate struct {
+	logger      *logging.Logger
+	certPath    string
+	keyPath     string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	hash        [sha256.Size]byte
+	checkTime   time.Time
+}
+
+func NewReloadableCertificate(logger *logging.Logger, certPath, keyPath string) (*ReloadableCertificate, error) {
+	certificate := &ReloadableCertificate{logger: logger, certPath: certPath, keyPath: keyPath,
+		checkTime: time.Now()}
+	if err := certificate.reload(); err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+func (c *ReloadableCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.checkTime) < certificateCheckInterval {
+		return c.certificate, nil
+	}
+	c.checkTime = now
+	if err := c.reload(); err != nil {
+		// Keep serving with previous certificate, new one may be written partially.
+		c.logger.Errorf("cannot reload certificate: %v", err)
+	}
+	return c.certificate, nil
+}
+
+func (c *ReloadableCertificate) reload() error {
+	certData, err := ioutil.ReadFile(c.certPath)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read certificate '%s'", c.certPath)
+	}
+	keyData, err := ioutil.ReadFile(c.keyPath)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read key '%s'", c.keyPath)
+	}
+	hash := sha256.Sum256(append(append(certData, 0), keyData...))
+	if c.certificate != nil && hash == c.hash {
+		return nil
+	}
+
+	certificate, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return errors.Wrapf(err, "cannot load certificate '%s'", c.certPath)
+	}
+	c.certificate = &certificate
+	c.hash = hash
+	if c.logger != nil {
+		c.logger.Infof("certificate '%s' is loaded", c.certPath)
+	}
+	return nil
+}
+
+// TLS settings of upstream, set by query parameters of upstream address.
+type UpstreamTLSConfig struct {
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+}
+
+func (c UpstreamTLSConfig) IsEmpty() bool {
+	return c == UpstreamTLSConfig{}
+}
+
+func CreateClientTLSConfig(config UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: config.ServerName}
+	var err error
+	if config.CA != "" {
+		if tlsConfig.RootCAs, err = LoadCertPool(config.CA); err != nil {
+			return nil, err
+		}
+	}
+	if config.Cert != "" || config.Key != "" {
+		certificate, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot load client certificate '%s'", config.Cert)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read CA bundle '%s'", path)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("CA bundle '%s' has no certificates", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for TLS tests.
+func writeTestCertificate(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "cannot generate key")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certData, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err, "cannot create certificate")
+	keyData, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err, "cannot encode key")
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certData}), 0600)
+	require.NoError(t, err, "cannot write certificate")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData}), 0600)
+	require.NoError(t, err, "cannot write key")
+	return certPath, keyPath
+}
+
+func getTestCertificateName(t *testing.T, certificate *tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err, "cannot parse certificate")
+	return parsed.Subject.CommonName
+}
+
+func createTestTLSDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tls-test")
+	require.NoError(t, err, "cannot create test directory")
+	return dir
+}
+
+// TLS tests.
+func TestReloadableCertificate(t *testing.T) {
+	dir := createTestTLSDir(t)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir, "first")
+	certificate, err := NewReloadableCertificate(logging.MustGetLogger("tls-test"), certPath, keyPath)
+	require.NoError(t, err, "cannot load certificate")
+
+	loaded, err := certificate.GetCertificate(nil)
+	require.NoError(t, err, "cannot get certificate")
+	require.Equal(t, "first", getTestCertificateName(t, loaded), "incorrect loaded certificate")
+
+	// Rotated files keep modification time of previous ones.
+	info, err := os.Stat(certPath)
+	require.NoError(t, err, "cannot get stat of certificate")
+	writeTestCertificate(t, dir, "second")
+	require.NoError(t, os.Chtimes(certPath, info.ModTime(), info.ModTime()), "cannot set time of certificate")
+	require.NoError(t, os.Chtimes(keyPath, info.ModTime(), info.ModTime()), "cannot set time of key")
+
+	loaded, err = certificate.GetCertificate(nil)
+	require.NoError(t, err, "cannot get certificate")
+	require.Equal(t, "first", getTestCertificateName(t, loaded), "files must not be checked before interval")
+
+	certificate.checkTime = time.Time{}
+	loaded, err = certificate.GetCertificate(nil)
+	require.NoError(t, err, "cannot get certificate")
+	require.Equal(t, "second", getTestCertificateName(t, loaded), "rotated certificate must be loaded")
+
+	// Partially written pair is not loaded.
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte("partial"), 0600), "cannot write key")
+	certificate.checkTime = time.Time{}
+	loaded, err = certificate.GetCertificate(nil)
+	require.NoError(t, err, "cannot get certificate")
+	require.Equal(t, "second", getTestCertificateName(t, loaded), "previous certificate must be kept")
+}
+
+func TestCreateServerTLSConfig(t *testing.T) {
+	dir := createTestTLSDir(t)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir, "localhost")
+
+	tlsConfig, err := CreateServerTLSConfig(nil, ListenerTLSConfig{})
+	require.NoError(t, err, "listener without TLS must be allowed")
+	require.Nil(t, tlsConfig, "listener without TLS must not have TLS config")
+	for _, config := range []ListenerTLSConfig{{Cert: certPath}, {Key: keyPath},
+		{Cert: certPath, Key: filepath.Join(dir, "none.pem")},
+		{Cert: certPath, Key: keyPath, ClientCA: filepath.Join(dir, "none.pem")},
+		{Cert: certPath, Key: keyPath, ClientCA: keyPath}} {
+
+		_, err := CreateServerTLSConfig(nil, config)
+		require.Error(t, err, "incorrect TLS config %+v must not be created", config)
+	}
+
+	tlsConfig, err = CreateServerTLSConfig(nil, ListenerTLSConfig{Cert: certPath, Key: keyPath,
+		ClientCA: certPath})
+	require.NoError(t, err, "cannot create TLS config")
+	require.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth, "client certificate must be required")
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err, "cannot listen")
+	defer listener.Close()
+	go func() {
+		connection, err := listener.Accept()
+		if err == nil {
+			connection.(*tls.Conn).Handshake()
+			connection.Close()
+		}
+	}()
+
+	clientConfig, err := CreateClientTLSConfig(UpstreamTLSConfig{CA: certPath, Cert: certPath, Key: keyPath,
+		ServerName: "localhost"})
+	require.NoError(t, err, "cannot create client TLS config")
+	connection, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp",
+		listener.Addr().String(), clientConfig)
+	require.NoError(t, err, "cannot make handshake with listener")
+	defer connection.Close()
+	require.Equal(t, "localhost", connection.ConnectionState().PeerCertificates[0].Subject.CommonName,
+		"certificate of listener must be returned")
+}
@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TraceparentHeader = "Traceparent"
+
+	traceparentVersion = "00"
+	sampledFlag        = 0x01
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext identifies span, it is propagated by W3C traceparent header.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// ParseTraceparent parses value of traceparent header:
+//
+//	<version>-<trace id>-<parent span id>-<flags>
+//
+// e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceparent(value string) (SpanContext, error) {
+	context := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		parts[0] == traceparentVersion && len(parts) != 4 {
+		return context, errors.Errorf("incorrect traceparent '%s'", value)
+	}
+	if err := decodeHex(context.TraceID[:], parts[1]); err != nil {
+		return context, errors.Wrapf(err, "incorrect trace id of traceparent '%s'", value)
+	}
+	if err := decodeHex(context.SpanID[:], parts[2]); err != nil {
+		return context, errors.Wrapf(err, "incorrect span id of traceparent '%s'", value)
+	}
+	flags := [1]byte{}
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return context, errors.Wrapf(err, "incorrect flags of traceparent '%s'", value)
+	}
+	context.Flags = flags[0]
+	if !context.IsValid() {
+		return context, errors.Errorf("traceparent '%s' contains zero id", value)
+	}
+	return context, nil
+}
+
+// Traceparent returns value of traceparent header which refers to span.
+func (c SpanContext) Traceparent() string {
+	return fmt.Sprintf("%s-%s-%s-%02x", traceparentVersion, c.TraceID, c.SpanID, c.Flags)
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+func (c SpanContext) IsSampled() bool {
+	return c.Flags&sampledFlag != 0
+}
+
+// Helpers
+func decodeHex(dst []byte, value string) error {
+	if len(value) != 2*len(dst) || strings.ToLower(value) != value {
+		return errors.Errorf("'%s' is not lowercase hex of %d bytes", value, len(dst))
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err
+}
+
+func newTraceID() (id TraceID) {
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	rand.Read(id[:])
+	return id
+}
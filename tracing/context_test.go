@@ -0,0 +1,38 @@
+package tracing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	context, err := ParseTraceparent(testTraceparent)
+	require.NoError(t, err, "cannot parse traceparent")
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", context.TraceID.String(), "incorrect trace id")
+	require.Equal(t, "00f067aa0ba902b7", context.SpanID.String(), "incorrect span id")
+	require.True(t, context.IsSampled(), "context must be sampled")
+	require.Equal(t, testTraceparent, context.Traceparent(), "incorrect traceparent")
+
+	// Future versions may contain additional fields.
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-qwerty")
+	require.NoError(t, err, "cannot parse traceparent of future version")
+}
+
+func TestParseIncorrectTraceparent(t *testing.T) {
+	incorrectTraceparents := []string{"", "qwerty",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0x"}
+	for _, traceparent := range incorrectTraceparents {
+		_, err := ParseTraceparent(traceparent)
+		require.Error(t, err, "incorrect traceparent '%s' must be parsed with error", traceparent)
+	}
+}
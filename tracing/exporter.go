@@ -0,0 +1,196 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	instrumentationName = "github.com/lyobzik/leska"
+
+	otlpStatusError = 2
+)
+
+// MemoryExporter keeps exported spans in memory, it is used in tests.
+type MemoryExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (e *MemoryExporter) Export(spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *MemoryExporter) Spans() []*Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+// OTLPExporter sends spans to collector by OTLP/HTTP with JSON encoding.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter creates exporter, endpoint is full URL of traces endpoint
+// (e.g. http://localhost:4318/v1/traces).
+func NewOTLPExporter(endpoint string, serviceName string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: timeout},
+	}
+}
+
+func (e *OTLPExporter) Export(spans []*Span) error {
+	data, err := json.Marshal(e.newRequest(spans))
+	if err != nil {
+		return errors.Wrap(err, "cannot encode spans")
+	}
+	response, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrapf(err, "cannot send spans to '%s'", e.endpoint)
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("collector '%s' returns %s", e.endpoint, response.Status)
+	}
+	return nil
+}
+
+// Subset of OTLP JSON encoding which is used by exporter.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (e *OTLPExporter) newRequest(spans []*Span) *otlpRequest {
+	scopeSpans := otlpScopeSpans{Scope: otlpScope{Name: instrumentationName}}
+	for _, span := range spans {
+		scopeSpans.Spans = append(scopeSpans.Spans, newOTLPSpan(span))
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: newOTLPAttributes(map[string]interface{}{
+			"service.name": e.serviceName,
+		})},
+		ScopeSpans: []otlpScopeSpans{scopeSpans},
+	}}}
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	result := otlpSpan{
+		TraceID:           span.Context.TraceID.String(),
+		SpanID:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        newOTLPAttributes(span.Attributes),
+	}
+	if span.Parent != (SpanID{}) {
+		result.ParentSpanID = span.Parent.String()
+	}
+	for _, link := range span.Links {
+		result.Links = append(result.Links,
+			otlpLink{TraceID: link.TraceID.String(), SpanID: link.SpanID.String()})
+	}
+	if span.Error != "" {
+		result.Status = &otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+	return result
+}
+
+func newOTLPAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value map[string]interface{}
+		switch typedValue := attributes[key].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": typedValue}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(typedValue)}
+		case int32:
+			value = map[string]interface{}{"intValue": strconv.Itoa(int(typedValue))}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(typedValue, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": typedValue}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(typedValue)}
+		}
+		result = append(result, otlpAttribute{Key: key, Value: value})
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan *otlpRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received := &otlpRequest{}
+		require.NoError(t, json.NewDecoder(request.Body).Decode(received), "cannot decode request")
+		requests <- received
+	}))
+	defer server.Close()
+
+	parent := parseTestTraceparent(t, testTraceparent)
+	span := &Span{
+		Name:       "server",
+		Kind:       ServerSpan,
+		Context:    SpanContext{TraceID: parent.TraceID, SpanID: newSpanID()},
+		Parent:     parent.SpanID,
+		Links:      []SpanContext{parent},
+		Start:      time.Unix(1, 0),
+		End:        time.Unix(2, 0),
+		Attributes: map[string]interface{}{"status": 200, "upstream": "http://upstream"},
+		Error:      "test error",
+	}
+	exporter := NewOTLPExporter(server.URL, "leska", time.Second)
+	require.NoError(t, exporter.Export([]*Span{span}), "cannot export spans")
+
+	received := <-requests
+	require.Len(t, received.ResourceSpans, 1, "incorrect number of resource spans")
+	resourceSpans := received.ResourceSpans[0]
+	require.Equal(t, "service.name", resourceSpans.Resource.Attributes[0].Key, "service name must be set")
+	require.Len(t, resourceSpans.ScopeSpans[0].Spans, 1, "incorrect number of spans")
+
+	exported := resourceSpans.ScopeSpans[0].Spans[0]
+	require.Equal(t, parent.TraceID.String(), exported.TraceID, "incorrect trace id")
+	require.Equal(t, span.Context.SpanID.String(), exported.SpanID, "incorrect span id")
+	require.Equal(t, parent.SpanID.String(), exported.ParentSpanID, "incorrect parent span id")
+	require.Equal(t, "1000000000", exported.StartTimeUnixNano, "incorrect start time")
+	require.Equal(t, []otlpLink{{TraceID: parent.TraceID.String(), SpanID: parent.SpanID.String()}},
+		exported.Links, "incorrect links")
+	require.Equal(t, &otlpStatus{Code: otlpStatusError, Message: "test error"}, exported.Status,
+		"incorrect status")
+	require.Equal(t, []otlpAttribute{
+		{Key: "status", Value: map[string]interface{}{"intValue": "200"}},
+		{Key: "upstream", Value: map[string]interface{}{"stringValue": "http://upstream"}},
+	}, exported.Attributes, "incorrect attributes")
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL, "leska", time.Second)
+	require.Error(t, exporter.Export([]*Span{{Name: "span"}}), "export must fail")
+}
@@ -0,0 +1,189 @@
+package tracing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lyobzik/go-utils"
+	"github.com/op/go-logging"
+)
+
+// Kinds of span, values are the same as in OTLP.
+type SpanKind int
+
+const (
+	InternalSpan SpanKind = 1
+	ServerSpan   SpanKind = 2
+	ClientSpan   SpanKind = 3
+)
+
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Links      []SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+	tracer     *Tracer
+}
+
+// SpanContext returns context of span, it is invalid for nil span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s != nil {
+		s.Attributes[key] = value
+	}
+}
+
+func (s *Span) SetError(err error) {
+	if s != nil && err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// Finish ends span and passes it to exporter.
+func (s *Span) Finish() {
+	if s != nil {
+		s.End = time.Now()
+		s.tracer.finish(s)
+	}
+}
+
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// Tracer creates spans and exports finished spans by batches. Nil tracer creates
+// nil spans, so tracing may be disabled without checks in callers.
+type Tracer struct {
+	logger    *logging.Logger
+	exporter  Exporter
+	batchSize int
+	interval  time.Duration
+	spans     chan *Span
+	mutex     sync.Mutex
+	dropped   int
+	stopper   *utils.Stopper
+}
+
+func NewTracer(logger *logging.Logger, exporter Exporter, batchSize int,
+	interval time.Duration) *Tracer {
+
+	return &Tracer{
+		logger:    logger,
+		exporter:  exporter,
+		batchSize: batchSize,
+		interval:  interval,
+		spans:     make(chan *Span, 16*batchSize),
+		stopper:   utils.NewStopper(),
+	}
+}
+
+func StartTracer(logger *logging.Logger, exporter Exporter, batchSize int,
+	interval time.Duration) *Tracer {
+
+	tracer := NewTracer(logger, exporter, batchSize, interval)
+	tracer.Spawn()
+	return tracer
+}
+
+func (t *Tracer) Spawn() {
+	t.stopper.Add()
+	go t.exportLoop()
+}
+
+// Stop exports all finished spans and stops tracer.
+func (t *Tracer) Stop() {
+	if t != nil {
+		t.stopper.Stop()
+		t.stopper.WaitDone()
+	}
+}
+
+// Start starts span. If parent is invalid span starts new trace. Links refer to
+// related spans of other traces.
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext,
+	links ...SpanContext) *Span {
+
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Context:    SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Flags: parent.Flags},
+		Links:      links,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+		tracer:     t,
+	}
+	if parent.IsValid() {
+		span.Parent = parent.SpanID
+	} else {
+		span.Context.TraceID, span.Context.Flags = newTraceID(), sampledFlag
+	}
+	return span
+}
+
+func (t *Tracer) finish(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		// Requests must not wait for exporter, so span is dropped if queue is full.
+		t.mutex.Lock()
+		t.dropped += 1
+		t.mutex.Unlock()
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	defer t.stopper.Done()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	for {
+		select {
+		case span := <-t.spans:
+			if batch = append(batch, span); len(batch) >= t.batchSize {
+				batch = t.export(batch)
+			}
+		case <-ticker.C:
+			batch = t.export(batch)
+		case <-t.stopper.Stopping:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			t.export(batch)
+			return
+		}
+	}
+}
+
+func (t *Tracer) export(batch []*Span) []*Span {
+	t.mutex.Lock()
+	dropped := t.dropped
+	t.dropped = 0
+	t.mutex.Unlock()
+	if dropped > 0 {
+		t.logger.Errorf("%d spans are dropped, export queue is full", dropped)
+	}
+
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := t.exporter.Export(batch); err != nil {
+		t.logger.Errorf("cannot export %d spans: %v", len(batch), err)
+	}
+	return []*Span{}
+}
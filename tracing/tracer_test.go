@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers for tracer tests.
+func startTestTracer(t *testing.T, exporter Exporter) *Tracer {
+	logger, err := logging.GetLogger("tracing_test")
+	require.NoError(t, err, "cannot create logger")
+	return StartTracer(logger, exporter, 2, time.Hour)
+}
+
+func parseTestTraceparent(t *testing.T, traceparent string) SpanContext {
+	context, err := ParseTraceparent(traceparent)
+	require.NoError(t, err, "cannot parse traceparent")
+	return context
+}
+
+// Tracer tests.
+func TestTracerSpans(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := startTestTracer(t, exporter)
+	parent := parseTestTraceparent(t, testTraceparent)
+
+	span := tracer.Start("server", ServerSpan, parent)
+	child := tracer.Start("storage", InternalSpan, span.SpanContext())
+	child.SetError(errors.New("test error"))
+	child.Finish()
+	span.SetAttribute("http.status_code", 202)
+	span.Finish()
+	root := tracer.Start("root", InternalSpan, SpanContext{}, parent)
+	root.Finish()
+	tracer.Stop()
+
+	spans := exporter.Spans()
+	require.Len(t, spans, 3, "all finished spans must be exported")
+	require.Equal(t, []*Span{child, span, root}, spans, "spans must be exported in finish order")
+
+	require.Equal(t, parent.TraceID, span.Context.TraceID, "span must join parent trace")
+	require.Equal(t, parent.SpanID, span.Parent, "incorrect parent of span")
+	require.Equal(t, span.Context.TraceID, child.Context.TraceID, "child must join parent trace")
+	require.Equal(t, span.Context.SpanID, child.Parent, "incorrect parent of child")
+	require.Equal(t, "test error", child.Error, "incorrect error of span")
+	require.Equal(t, 202, span.Attributes["http.status_code"], "incorrect attribute of span")
+
+	require.NotEqual(t, parent.TraceID, root.Context.TraceID, "span without parent must start trace")
+	require.True(t, root.Context.IsValid(), "span context must be valid")
+	require.True(t, root.Context.IsSampled(), "new trace must be sampled")
+	require.Equal(t, []SpanContext{parent}, root.Links, "incorrect links of span")
+}
+
+func TestDisabledTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start("server", ServerSpan, SpanContext{})
+	require.Nil(t, span, "disabled tracer must not create spans")
+	require.False(t, span.SpanContext().IsValid(), "context of nil span must be invalid")
+
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("test error"))
+	span.Finish()
+	tracer.Stop()
+}
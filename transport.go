@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type TransportConfig struct {
+	DialTimeout           time.Duration `long:"dial-timeout" default:"30s" description:"timeout of connection to upstream"`
+	TLSHandshakeTimeout   time.Duration `long:"tls-handshake-timeout" default:"10s" description:"timeout of TLS handshake with upstream"`
+	ResponseHeaderTimeout time.Duration `long:"response-header-timeout" default:"0s" description:"timeout of waiting for upstream response headers (0 - unlimited)"`
+	Timeout               time.Duration `long:"timeout" default:"0s" description:"total timeout of upstream request including reading of response body (0 - unlimited)"`
+	KeepAlive             time.Duration `long:"keep-alive" default:"30s" description:"keep-alive period of upstream connections"`
+	DisableKeepAlives     bool          `long:"disable-keep-alives" description:"do not reuse upstream connections"`
+	MaxIdleConns          int           `long:"max-idle-conns" default:"100" description:"maximum number of idle upstream connections"`
+	MaxIdleConnsPerHost   int           `long:"max-idle-conns-per-host" default:"2" description:"maximum number of idle connections per upstream"`
+	IdleConnTimeout       time.Duration `long:"idle-conn-timeout" default:"90s" description:"time after which idle upstream connection is closed"`
+}
+
+// CreateTransport creates transport for upstream requests. Errors of transport
+// (including timeouts) are converted by forwarder to 5xx-responses, so request
+// which is timed out is treated as failed and is stored for repeating. Upstreams
+// with own TLS settings get separate transports.
+func CreateTransport(config TransportConfig, upstreams []*Upstream) http.RoundTripper {
+	transport := &upstreamsTransport{
+		transport: createTransport(config, nil),
+		upstreams: make(map[string]http.RoundTripper),
+	}
+	for _, upstream := range upstreams {
+		if upstream.TLS != nil {
+			transport.upstreams[getUpstreamKey(upstream.URL)] = createTransport(config, upstream.TLS)
+		}
+	}
+	if len(transport.upstreams) == 0 {
+		return transport.transport
+	}
+	return transport
+}
+
+func createTransport(config TransportConfig, tlsConfig *tls.Config) http.RoundTripper {
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: config.KeepAlive,
+		}).DialContext,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		DisableKeepAlives:     config.DisableKeepAlives,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+	}
+	if config.Timeout <= 0 {
+		return transport
+	}
+	return &timeoutTransport{transport: transport, timeout: config.Timeout}
+}
+
+// Transport which chooses transport by upstream address.
+type upstreamsTransport struct {
+	transport http.RoundTripper
+	upstreams map[string]http.RoundTripper
+}
+
+func (t *upstreamsTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if transport, exist := t.upstreams[getUpstreamKey(request.URL)]; exist {
+		return transport.RoundTrip(request)
+	}
+	return t.transport.RoundTrip(request)
+}
+
+// Transport which limits total time of request. Deadline is kept until response
+// body is closed, so it also limits time of reading response body.
+type timeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(request.Context(), t.timeout)
+	response, err := t.transport.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	response.Body = &cancelOnCloseBody{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Helpers
+func getUpstreamKey(upstream *url.URL) string {
+	return upstream.Scheme + "://" + upstream.Host
+}